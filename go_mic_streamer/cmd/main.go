@@ -1,80 +1,430 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/websocket"
 
+	"github.com/killinsun/voice-conversation-ai/go_mic_streamer/conversation"
+	"github.com/killinsun/voice-conversation-ai/go_mic_streamer/mediastream"
 	player "github.com/killinsun/voice-conversation-ai/go_mic_streamer/player"
 	pcm "github.com/killinsun/voice-conversation-ai/go_mic_streamer/recorder"
 )
 
-type MediaStruct struct {
-	Track     string `json:"track"`
-	Chunk     int    `json:"chunk"`
-	Timestamp int    `json:"timestamp"`
-	Payload   string `json:"payload"`
-}
+func main() {
+	voicevoxEndpoints := flag.String("voicevox", "http://localhost:50021", "comma separated VOICEVOX engine endpoints")
+	voicevoxTimeout := flag.Duration("voicevox-timeout", 10*time.Second, "timeout for each VOICEVOX request")
+	voicevoxRetries := flag.Int("voicevox-retries", 2, "number of retries for failed VOICEVOX requests")
+	fallbackFile := flag.String("fallback-wav", "", "WAV file played when synthesis fails")
+	output := flag.String("output", "oto", "reply audio output: oto, portaudio:DEVICE, wav:PATH, pcm (stdout) or null")
+	listOutputDevices := flag.Bool("list-output-devices", false, "print output devices usable with -output portaudio:DEVICE and exit")
+	speechRate := flag.Float64("speech-rate", 1.0, "playback speed of replies, 0.25 to 4; below 1.0 is slower, pitch is kept")
+	writeSubtitles := flag.Bool("subtitles", false, "write SRT/WebVTT captions of AI replies next to the recording")
+	liveCaptions := flag.Bool("live-captions", false, "log each word of an AI reply as it is heard")
+	bargeIn := flag.Bool("barge-in", false, "keep listening while the AI speaks and stop the reply when the user talks over it")
+	filler := flag.String("filler", "少々お待ちください", "phrase said when a reply is slow; empty plays only the hold tone")
+	fillerDelay := flag.Duration("filler-delay", 2*time.Second, "play the filler when no reply arrived this long after sending a segment; 0 disables it")
+	noInputTimeout := flag.Duration("no-input-timeout", 8*time.Second, "how long to wait for the user to talk after the AI finished speaking before counting a no-input; 0 waits forever")
+	maxNoInput := flag.Int("max-no-input", 3, "consecutive no-inputs before saying goodbye and ending the session")
+	reprompt := flag.String("reprompt", "もしもし、お声が届いていますでしょうか。", "phrase said locally on no-input when the backend did not accept no_input events; empty says nothing")
+	goodbye := flag.String("goodbye", "お電話ありがとうございました。失礼いたします。", "phrase said before ending the session after too many no-inputs")
+	maxSession := flag.Duration("max-session", 0, "end the session with a closing phrase after this long; 0 means no limit")
+	sessionWarning := flag.Duration("session-warning", 0, "send a session_warning event to the backend after this long; needs -max-session, 0 disables it")
+	closing := flag.String("closing", "お時間になりましたので、これで失礼いたします。", "phrase said when the session reaches -max-session")
+	codecName := flag.String("codec", "", "audio encoding sent to the backend: mulaw, alaw (G.711, 8kHz) or l16 (16kHz linear PCM); empty means mulaw with -protocol twilio and l16 with legacy")
+	protocol := flag.String("protocol", "legacy", "media protocol: legacy (one WAV file per media message, what voice_conversation_ai/main.py reads) or twilio (Media Streams, 20ms μ-law frames)")
+	replyTimeout := flag.Duration("reply-timeout", 30*time.Second, "go back to listening when no reply arrives within this time")
+	jitterBuffer := flag.Duration("jitter-buffer", 200*time.Millisecond, "audio from the backend buffered before playback starts")
+	sendQueue := flag.Duration("send-queue", time.Minute, "audio kept for the backend while reconnecting; the oldest utterances are dropped beyond that, 0 keeps everything")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 10*time.Second, "how often to ping the backend; 0 disables pings")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 30*time.Second, "reconnect when nothing was heard from the backend for this long; 0 disables the check")
+	languages := flag.String("language", "ja-JP", "comma separated language hints sent to the backend in the hello")
+	helloTimeout := flag.Duration("hello-timeout", 2*time.Second, "how long to wait for the backend to answer the hello; 0 skips the handshake")
+	framingFlag := flag.String("framing", "auto", "media framing on the websocket: auto (binary if the server accepts it), json, or binary (like auto but warns when the server only takes JSON)")
+	flag.Parse()
 
-type MediaStreamStruct struct {
-	Event          string      `json:"event"`
-	SequenceNumber int         `json:"sequenceNumber"`
-	Media          MediaStruct `json:"media"`
-	StreamSid      string      `json:"streamSid"`
-}
+	log.SetFlags(log.Lmicroseconds)
 
-type RecordingState struct {
-	startChan   chan struct{}
-	stopChan    chan struct{}
-	isRecording bool
-	mu          sync.Mutex
-}
+	audioSystem := &pcm.PortAudioSystem{}
+	if *listOutputDevices {
+		printOutputDevices(audioSystem)
+		return
+	}
 
-func main() {
-	log.SetFlags(log.Lmicroseconds)
+	wsConfig, err := websocket.NewConfig("ws://localhost:8000/ws_test", "http://localhost:8000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch *framingFlag {
+	case "auto", "binary":
+		// サーバーが選ばなかったときは Protocol が提示したままになるので、JSON も必ず並べる
+		wsConfig.Protocol = []string{string(mediastream.FramingBinary), string(mediastream.FramingJSON)}
+	case "json":
+	default:
+		log.Fatalf("unknown framing %q", *framingFlag)
+	}
+	conn := mediastream.NewConn(wsConfig)
+	conn.HeartbeatInterval = *heartbeatInterval
+	conn.HeartbeatTimeout = *heartbeatTimeout
+	defer conn.Close()
 
-	ws, dialErr := websocket.Dial("ws://localhost:8000/ws_test", "", "http://localhost:8000")
-	if dialErr != nil {
-		log.Fatal(dialErr)
+	if *protocol != "twilio" && *protocol != "legacy" {
+		log.Fatalf("unknown protocol %q", *protocol)
+	}
+	if *sessionWarning > 0 && (*maxSession <= 0 || *sessionWarning >= *maxSession) {
+		log.Fatal("-session-warning needs a longer -max-session")
+	}
+	if *codecName == "" {
+		// legacy のバックエンドには録音したままの 16kHz WAV を送る
+		*codecName = "mulaw"
+		if *protocol == "legacy" {
+			*codecName = "l16"
+		}
+	}
+	codec, err := mediastream.CodecByName(*codecName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 接続するまでは送ったものを溜めておき、OnConnect で流す
+	stream := mediastream.NewStream(nil, map[string]string{"resumeToken": conn.ResumeToken})
+	stream.Codec = codec
+	stream.MaxBacklog = *sendQueue
+	outbox := mediastream.NewOutbox(stream)
+	// 指定されたコーデックを先頭に、残りも候補として提示する
+	offered := []mediastream.Codec{codec}
+	for _, c := range []mediastream.Codec{mediastream.Mulaw, mediastream.Alaw, mediastream.L16} {
+		if c.Name != codec.Name {
+			offered = append(offered, c)
+		}
+	}
+	hello := mediastream.Hello{
+		Version:   mediastream.ProtocolVersion,
+		Codecs:    mediastream.OfferCodecs(offered...),
+		Framings:  []mediastream.Framing{mediastream.FramingJSON},
+		Languages: strings.Split(*languages, ","),
+		Features: []string{mediastream.FeatureMarks, mediastream.FeatureDTMF, mediastream.FeatureAudio, mediastream.FeatureAcks,
+			mediastream.FeatureNoInput, mediastream.FeatureSessionWarning},
+	}
+	if *framingFlag != "json" {
+		hello.Framings = []mediastream.Framing{mediastream.FramingBinary, mediastream.FramingJSON}
+	}
+	if *bargeIn {
+		hello.Features = append(hello.Features, mediastream.FeatureBargeIn)
+	}
+	// バックエンドが受け付けた機能。hello に答えない古いバックエンドには Twilio 由来のものだけ使う
+	var backendBargeIn, backendAudio atomic.Bool
+	applyFeatures := func(welcome *mediastream.Welcome) {
+		has := func(feature string) bool { return welcome == nil || welcome.Has(feature) }
+		backendBargeIn.Store(*bargeIn && has(mediastream.FeatureBargeIn))
+		backendAudio.Store(has(mediastream.FeatureAudio))
+		if welcome != nil {
+			outbox.SetAcking(welcome.Has(mediastream.FeatureAcks))
+			stream.SetFeatures(welcome.Features)
+		} else {
+			stream.SetFeatures([]string{mediastream.FeatureMarks, mediastream.FeatureDTMF, mediastream.FeatureAudio})
+		}
+	}
+	applyFeatures(nil)
+	if *protocol == "legacy" {
+		// legacy のバックエンドは media しか読めない
+		stream.SetFeatures(nil)
+	}
+
+	// セッションを終える理由
+	ended := make(chan string, 1)
+	endSession := func(reason string) {
+		select {
+		case ended <- reason:
+		default:
+		}
+	}
+	// 提示していないものを選ぶバックエンドには、つなぎ直しても同じ答えが返る
+	refuseWelcome := func(err error) error {
+		log.Println("Giving up on the backend:", err)
+		endSession(err.Error())
+		conn.Close()
+		return err
+	}
+
+	conn.OnConnect = func(ws *websocket.Conn, send mediastream.Sender, reconnect bool) error {
+		framing := mediastream.NegotiateFraming(ws.Config().Protocol)
+		selected := codec
+		if *protocol == "twilio" && *helloTimeout > 0 {
+			welcome, rest, err := mediastream.Handshake(ws, send, hello, *helloTimeout)
+			if errors.Is(err, mediastream.ErrBadWelcome) {
+				return refuseWelcome(err)
+			}
+			if err != nil {
+				return err
+			}
+			applyFeatures(welcome)
+			if welcome != nil {
+				if selected, err = welcome.SelectedCodec(codec); err != nil {
+					return refuseWelcome(err)
+				}
+				if welcome.Framing != "" {
+					framing = welcome.Framing
+				}
+				log.Printf("Backend speaks version %d, chose %s at %dHz, language %q, features %v",
+					welcome.Version, selected.Name, selected.SampleRate, welcome.Language, welcome.Features)
+			} else {
+				log.Println("Backend did not answer the hello, using the defaults")
+				if rest != nil {
+					conn.OnMessage(rest)
+				}
+			}
+		}
+		if *framingFlag == "binary" && framing != mediastream.FramingBinary {
+			log.Println("The server did not accept binary framing, falling back to JSON")
+		}
+		log.Println("Media framing:", framing)
+		stream.SetCodec(selected)
+		stream.SetFraming(framing)
+		if *protocol == "twilio" {
+			// 再接続のときも connected と start を送り直してから、切断中に溜まった分を流す
+			if err := stream.Announce(send); err != nil {
+				return err
+			}
+			if reconnect {
+				// 受領確認のない区間を、切断中に溜まった分より先に送り直す。溜まっていて未送信の区間は対象外
+				if n, err := outbox.Retransmit(); n > 0 || err != nil {
+					log.Printf("Retransmitting %d unacked segments: %v", n, err)
+				}
+			}
+		}
+		return stream.Attach(send)
 	}
-	defer ws.Close()
+	defer stream.Stop()
 
 	baseDir := time.Now().Format("audio_20060102_T150405")
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		log.Fatal("Could not create a new directory")
 	}
 
-	audioSystem := &pcm.PortAudioSystem{}
+	vc := player.NewVoicevoxClient(strings.Split(*voicevoxEndpoints, ","), *voicevoxTimeout, *voicevoxRetries)
+	vc.StartHealthChecks(context.Background(), 5*time.Second)
+	pl := player.NewPlayer(vc, *fallbackFile)
+	sink, err := player.NewSink(*output, outputSystem{audioSystem})
+	if err != nil {
+		log.Fatal(err)
+	}
+	pl.Sink = sink
+	pl.SetSpeechRate(*speechRate)
+	defer pl.Close()
+	if *writeSubtitles {
+		subtitles, err := player.NewSubtitleWriter(baseDir+"/replies", time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer subtitles.Close()
+		pl.Subtitles = subtitles
+	}
+	if *liveCaptions {
+		pl.OnTiming = func(ev player.TimingEvent) {
+			if ev.Kind == player.TimingWord {
+				log.Println("AI (speaking):", ev.Text)
+			}
+		}
+	}
+	// 自分で鳴らしたトーンを -barge-in のマイクが拾っても、押されたキーとして扱わない
+	var toneHeardUntil atomic.Int64
+	pl.OnTone = func(playing bool) {
+		if playing {
+			toneHeardUntil.Store(math.MaxInt64)
+			return
+		}
+		// 出力の遅れの分だけ余裕を見る
+		toneHeardUntil.Store(time.Now().Add(300 * time.Millisecond).UnixNano())
+	}
+
+	sessionLog, err := newSessionLog(baseDir + "/session.log")
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionLog.Println("session started")
+
+	hold := player.NewHoldAudio(pl, *filler, *fillerDelay)
+
 	pr := pcm.NewPCMRecorder(audioSystem, fmt.Sprintf(baseDir+"/file"), 30, 150)
+	// 区間のファイルも送るときのコーデックで書く
+	pr.EncodeSegment = func(samples []int16, sampleRate int) []byte {
+		return mediastream.EncodeWAV(samples, sampleRate, stream.CurrentCodec())
+	}
+	// 保留音を録音しないようにし、止まったら録音に戻す。返答を話すときは下の Observe が改めて決める
+	hold.OnPlay = pr.Pause
+	hold.OnStop = pr.Resume
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, os.Kill)
-
+	recorderStop := make(chan os.Signal, 1)
 	filePathCh := make(chan string)
 
-	log.Println("Initializing recording state")
-	recordingState := &RecordingState{
-		startChan:   make(chan struct{}),
-		stopChan:    make(chan struct{}),
-		isRecording: false,
+	machine := conversation.NewMachine()
+	machine.SetTimeout(conversation.WaitingForReply, *replyTimeout)
+	// 区間は最長でも pr.Interval 秒で送られるので、それを過ぎても話し中のままなら聞き取りに戻す
+	machine.SetTimeout(conversation.UserSpeaking, time.Duration(pr.Interval)*time.Second+5*time.Second)
+	// 無入力は AI が話し終えてから数える。無入力や短い物音のあとも続けて数える
+	machine.SetTimeoutFrom(conversation.Listening, *noInputTimeout, conversation.Speaking, conversation.Listening, conversation.UserSpeaking)
+	machine.Observe(func(t conversation.Transition) {
+		log.Printf("Conversation: %v -> %v (%s)", t.From, t.To, t.Event)
+		if t.From == conversation.WaitingForReply && t.To != conversation.WaitingForReply {
+			hold.Stop()
+		}
+		switch t.To {
+		case conversation.Listening, conversation.UserSpeaking:
+			pr.Resume()
+		case conversation.WaitingForReply:
+			pr.Resume()
+			if *fillerDelay > 0 {
+				hold.Start()
+			}
+		case conversation.Speaking:
+			if backendBargeIn.Load() {
+				pr.Resume()
+			} else {
+				pr.Pause()
+			}
+		case conversation.Interrupted:
+			pl.Stop()
+			pr.Resume()
+		case conversation.Ended:
+			pr.Pause()
+			pl.Stop()
+		}
+	})
+
+	// AI の発話は一つずつ再生する
+	var speakMu sync.Mutex
+	respond := func(play func() error) {
+		speakMu.Lock()
+		defer speakMu.Unlock()
+		if machine.State() == conversation.Ended {
+			return
+		}
+		machine.Fire(conversation.EventReplyReceived)
+		// 保留音が鳴り終わってから返答を再生する
+		hold.Stop()
+		err := play()
+		// 割り込みで止まったときは状態が先に変わっている。バックエンドの stop のときは話し終えたことにする
+		if err == player.ErrStopped && machine.State() != conversation.Speaking {
+			return
+		}
+		if err != nil && err != player.ErrStopped {
+			log.Println("Error saying reply:", err)
+		}
+		machine.Fire(conversation.EventPlaybackFinished)
+	}
+	speak := func(text string) {
+		respond(func() error {
+			log.Println("starting Say")
+			return pl.Say(text)
+		})
+	}
+
+	// 締めの言葉を言い始めたら、バックエンドからの返答や割り込みは受け付けない
+	var wrappingUp atomic.Bool
+	wrapUp := func(text string, reason string) {
+		if wrappingUp.Swap(true) {
+			return
+		}
+		sessionLog.Println("wrapping up:", reason)
+		go func() {
+			pl.Stop()
+			speak(text)
+			endSession(reason)
+		}()
+	}
+
+	noInput := conversation.NewNoInputWatcher(*maxNoInput, func(count int) {
+		log.Printf("No input (%d in a row)", count)
+		// 受け付けたバックエンドには任せ、そうでなければ手元で促す
+		if stream.Accepts(mediastream.FeatureNoInput) {
+			if err := stream.SendEvent("no_input", map[string]int{"count": count}); err != nil {
+				log.Println("Error sending no_input:", err)
+			}
+			return
+		}
+		if *reprompt != "" {
+			go speak(*reprompt)
+		}
+	}, func() {
+		log.Printf("No input %d times in a row, ending the session", *maxNoInput)
+		wrapUp(*goodbye, "no input")
+	})
+	machine.Observe(noInput.Observe)
+
+	budget := conversation.NewSessionBudget(*sessionWarning, *maxSession)
+	budget.OnWarning = func(remaining time.Duration) {
+		sessionLog.Printf("session warning, %v left", remaining)
+		if !stream.Accepts(mediastream.FeatureSessionWarning) {
+			return
+		}
+		event := map[string]int{"remaining": int(remaining.Seconds())}
+		if err := stream.SendEvent("session_warning", event); err != nil {
+			log.Println("Error sending session_warning:", err)
+		}
+	}
+	budget.OnLimit = func() {
+		wrapUp(*closing, "session time limit")
 	}
 
-	log.Println("Initializing recording state ... ok")
+	pr.OnSpeechStart = func() {
+		if wrappingUp.Load() {
+			return
+		}
+		if machine.State() == conversation.Speaking {
+			machine.Fire(conversation.EventBargeIn)
+		}
+		machine.Fire(conversation.EventSpeechStarted)
+	}
+
+	pr.OnSpeechDropped = func() {
+		machine.Fire(conversation.EventSegmentDropped)
+	}
+
+	pr.OnDTMF = func(ev pcm.DTMFEvent) {
+		log.Printf("DTMF: %s at %v", ev.Digit, ev.At)
+		if time.Now().UnixNano() < toneHeardUntil.Load() {
+			log.Println("Ignoring a key heard while playing a tone")
+			return
+		}
+		if wrappingUp.Load() {
+			return
+		}
+		// legacy のバックエンドや DTMF を受け付けないバックエンドには送らない
+		if !stream.Accepts(mediastream.FeatureDTMF) {
+			log.Printf("The backend does not take DTMF, ignoring the key press %s", ev.Digit)
+			return
+		}
+		// 番号は音声区間ではなく専用のメッセージで送る
+		if err := stream.SendDTMF(ev.Digit); err != nil {
+			log.Println("Error sending dtmf:", err)
+			return
+		}
+		if machine.State() == conversation.Speaking {
+			machine.Fire(conversation.EventBargeIn)
+		}
+		machine.Fire(conversation.EventDTMF)
+	}
 
 	var wait sync.WaitGroup
 	wait.Add(1)
 
 	// 実際に音声ストリームを処理するゴルーチン
 	go func() {
-		if err := pr.Start(sig, filePathCh, &wait, recordingState.startChan, recordingState.stopChan); err != nil {
+		if err := pr.Start(recorderStop, filePathCh, &wait); err != nil {
 			log.Fatalf("Error starting PCMRecorder: %v", err)
 		}
 	}()
@@ -86,95 +436,314 @@ func main() {
 			if !ok {
 				break
 			}
-			recordingState.mu.Lock()
-			isRecording := recordingState.isRecording
-			recordingState.mu.Unlock()
-			if isRecording {
-				b, err := ioutil.ReadFile(filePath)
-				if err != nil {
-					log.Fatal(err)
-				}
-				b64EncodedWav := base64.StdEncoding.EncodeToString(b)
+			switch machine.State() {
+			case conversation.Listening, conversation.UserSpeaking, conversation.WaitingForReply, conversation.Interrupted:
+			default:
+				// AI の発話中に録れたものは送らない
+				machine.Fire(conversation.EventSegmentDropped)
+				continue
+			}
+			b, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				log.Println("Error reading segment:", err)
+				machine.Fire(conversation.EventSegmentDropped)
+				continue
+			}
 
-				if err := sendMediaStream(ws, b64EncodedWav); err != nil {
-					log.Fatal(err)
-				}
+			// 切断中は Conn のキューに溜まり、再接続後に送られる
+			if err := sendSegment(stream, outbox, *protocol, b); err != nil {
+				log.Println("Error sending segment:", err)
+				machine.Fire(conversation.EventSegmentDropped)
+				continue
 			}
+			machine.Fire(conversation.EventSegmentSent)
 		}
 	}()
 
-	// WebSocketからテキストを受信した際のゴルーチン
+	// 返答とマークは届いた順に処理する。マークは直前までの返答が聞こえ終わってから送り返す
+	playback := newPlaybackQueue()
+	// マークを受け付けないバックエンドには送り返さない
+	sendMark := func(name string) {
+		if !stream.Accepts(mediastream.FeatureMarks) {
+			return
+		}
+		if err := stream.SendMark(name); err != nil {
+			log.Println("Error sending mark:", err)
+		}
+	}
 	go func() {
-		var msg = make([]byte, 512)
 		for {
-			n, err := ws.Read(msg)
-			if err != nil {
-				log.Println("Error reading from WebSocket:", err)
+			item := playback.pop()
+			if item.mark != "" {
+				pl.Drain()
+				sendMark(item.mark)
 				continue
 			}
-			receivedText := string(msg[:n])
-			log.Println("AI:", receivedText)
-
-			stopRecording(recordingState)
+			if wrappingUp.Load() {
+				if item.audio != nil {
+					item.audio.Discard()
+				}
+				continue
+			}
+			if item.audio != nil {
+				respond(func() error { return pl.PlayStream(item.audio) })
+				continue
+			}
+			speak(item.text)
+		}
+	}()
 
-			log.Println("starting Say")
-			err = player.Say(receivedText)
+	clearReplies := func() {
+		log.Println("Clear received, dropping queued replies")
+		clearPlayback(playback, sendMark)
+		pl.Stop()
+	}
+	// 受信中のバックエンド音声。受信ゴルーチンだけが触る
+	audioStreams := map[string]*player.AudioStream{}
+	dispatcher := &mediastream.Dispatcher{
+		OnReply: func(r mediastream.Reply) {
+			log.Println("AI:", r.Text)
+			playback.push(playbackItem{text: r.Text})
+		},
+		OnPartialReply: func(r mediastream.Reply) {
+			log.Println("AI (partial):", r.Text)
+		},
+		OnTranscript: func(t mediastream.Transcript) {
+			if t.Final {
+				log.Println("User:", t.Text)
+				sessionLog.Println("user:", t.Text)
+			}
+		},
+		OnAudio: func(a mediastream.Audio) {
+			if !backendAudio.Load() {
+				log.Printf("Ignoring audio %s from a backend that did not accept audio", a.ID)
+				return
+			}
+			samples, sampleRate, err := a.Decode()
 			if err != nil {
-				log.Fatal("Error!", err)
+				log.Println("Error decoding audio from backend:", err)
+				return
 			}
+			// 分割して届く音声は同じ ID のストリームにまとめて、最初のチャンクで再生待ちに入れる
+			s := audioStreams[a.ID]
+			if s == nil {
+				s = player.NewAudioStream(*jitterBuffer)
+				playback.push(playbackItem{audio: s})
+			}
+			mark := a.MarkName()
+			s.Push(samples, sampleRate, func() {
+				if mark != "" {
+					sendMark(mark)
+				}
+			})
+			if a.Streamed() {
+				audioStreams[a.ID] = s
+			} else {
+				s.Close()
+				delete(audioStreams, a.ID)
+			}
+		},
+		OnControl: func(c mediastream.Control) {
+			log.Printf("Control: %+v", c)
+			switch c.Command {
+			case mediastream.ControlStop:
+				pl.Stop()
+			case mediastream.ControlClear:
+				clearReplies()
+			case mediastream.ControlHangup:
+				endSession("hangup by backend: " + c.Reason)
+			case mediastream.ControlSetVoice:
+				go func() {
+					if err := pl.SetVoice(context.Background(), c.Speaker, c.Style); err != nil {
+						log.Println("Error setting voice:", err)
+					}
+				}()
+			default:
+				log.Printf("Unknown control command %q", c.Command)
+			}
+		},
+		OnError: func(e mediastream.BackendError) {
+			log.Println("Error from backend:", e.Error())
+			sessionLog.Println(e.Error())
+			if e.Fatal {
+				endSession(e.Error())
+			}
+		},
+		OnMark: func(m mediastream.Mark) {
+			playback.push(playbackItem{mark: m.Name})
+		},
+		OnClear: clearReplies,
+		OnAck: func(a mediastream.Ack) {
+			if !outbox.Ack(a.ID) {
+				log.Printf("Duplicate or unknown ack for segment %s", a.ID)
+			}
+		},
+		OnNack: func(a mediastream.Ack) {
+			log.Printf("Backend could not process segment %s: %s", a.ID, a.Reason)
+			if err := outbox.Nack(a.ID); err != nil {
+				log.Println("Error resending segment:", err)
+				sessionLog.Println("segment lost:", err)
+			}
+		},
+	}
 
-			startRecording(recordingState)
+	// WebSocket からメッセージを受信したときの処理。長い返答も途中で切れないよう、フレーム全体を読む
+	conn.OnMessage = func(data []byte) {
+		if err := dispatcher.Dispatch(data); err != nil {
+			log.Println("Error handling message from backend:", err)
 		}
-	}()
+	}
+	conn.OnDisconnect = func(err error) {
+		log.Println("Lost the connection to the backend:", err)
+		sessionLog.Println("disconnected:", err)
+		stream.Detach()
+		// 送り直す区間が残っていれば、再接続後に返答が来るのでそのまま待つ
+		if n := outbox.Outstanding(); n > 0 {
+			log.Printf("Still waiting for the reply, %d segments will be sent again", n)
+			return
+		}
+		machine.Fire(conversation.EventDisconnected)
+	}
+	conn.Start()
+
+	machine.Fire(conversation.EventStart)
+	budget.Start()
 
-	<-sig
+	var reason string
+	select {
+	case s := <-sig:
+		reason = s.String()
+	case reason = <-ended:
+	}
+	log.Println("Session ended:", reason)
+	sessionLog.Println("session ended:", reason)
+	stats := stream.Stats()
+	log.Printf("Sent %d messages of %d bytes (%d bytes of audio) with %s framing, %d bytes on the wire; encoding took %v",
+		stats.Messages, stats.MessageBytes, stats.AudioBytes, stream.Framing, conn.BytesWritten(), stats.EncodeTime)
+	sessionLog.Printf("sent %d messages of %d bytes (%d bytes of audio) with %s framing, %d bytes on the wire, encode time %v",
+		stats.Messages, stats.MessageBytes, stats.AudioBytes, stream.Framing, conn.BytesWritten(), stats.EncodeTime)
+	budget.Stop()
+	hold.Stop()
+	machine.Fire(conversation.EventHangup)
+	recorderStop <- os.Interrupt
 	wait.Wait()
 }
 
-func sendMediaStream(ws *websocket.Conn, payload string) error {
-	media := MediaStruct{
-		"inbound",
-		1,
-		300,
-		payload,
-	}
-	mediaStream := MediaStreamStruct{
-		"media",
-		301,
-		media,
-		"dummy",
+func printOutputDevices(audioSystem pcm.AudioSystem) {
+	if err := audioSystem.Initialize(); err != nil {
+		log.Fatal(err)
 	}
+	defer audioSystem.Terminate()
 
-	jsonData, err := json.Marshal(mediaStream)
+	devices, err := audioSystem.ListOutputDevices()
 	if err != nil {
 		log.Fatal(err)
-		return nil
 	}
+	for _, d := range devices {
+		fmt.Printf("%s\t(%s, %d ch, %.0f Hz)\n", d.Name, d.HostApi, d.MaxOutputChannels, d.DefaultSampleRate)
+	}
+}
 
-	sendErr := websocket.Message.Send(ws, string(jsonData))
-	if sendErr != nil {
-		log.Fatal(sendErr)
+// outputSystem lets the player open output streams through the recorder's
+// AudioSystem.
+type outputSystem struct {
+	pcm.AudioSystem
+}
+
+func (o outputSystem) DefaultSampleRate(deviceName string) (int, error) {
+	device, err := o.OutputDevice(deviceName)
+	return int(device.DefaultSampleRate), err
+}
+
+func (o outputSystem) OpenOutputStream(deviceName string, channels int, sampleRate float64, framesPerBuffer int, buf []int16) (player.OutputStream, error) {
+	return o.AudioSystem.OpenOutputStream(deviceName, channels, sampleRate, framesPerBuffer, buf)
+}
+
+func newSessionLog(path string) (*log.Logger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
 	}
+	return log.New(file, "", log.LstdFlags|log.Lmicroseconds), nil
+}
+
+// playbackItem is a reply to say, audio from the backend to play, or a mark
+// to send back once everything before it was played.
+type playbackItem struct {
+	text  string
+	audio *player.AudioStream
+	mark  string
+}
+
+// playbackQueue hands replies and marks to the playback goroutine. push never
+// blocks, so a long reply does not hold up the websocket read goroutine.
+type playbackQueue struct {
+	items []playbackItem
+	cond  *sync.Cond
+	mu    sync.Mutex
+}
+
+func newPlaybackQueue() *playbackQueue {
+	q := &playbackQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *playbackQueue) push(item playbackItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
+	q.cond.Signal()
+}
 
-	log.Printf("Send: %d to Server", mediaStream.SequenceNumber)
+// pop waits for the next item.
+func (q *playbackQueue) pop() playbackItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 {
+		q.cond.Wait()
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	return item
+}
 
-	return nil
+// drain takes every queued item.
+func (q *playbackQueue) drain() []playbackItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	return items
 }
 
-func startRecording(state *RecordingState) {
-	state.mu.Lock()
-	defer state.mu.Unlock()
-	if !state.isRecording {
-		state.startChan <- struct{}{}
-		state.isRecording = true
+// clearPlayback drops replies that have not started yet. Marks among them
+// are sent back at once, as Twilio does for cleared audio.
+func clearPlayback(playback *playbackQueue, sendMark func(name string)) {
+	for _, item := range playback.drain() {
+		if item.audio != nil {
+			item.audio.Discard()
+		}
+		if item.mark != "" {
+			sendMark(item.mark)
+		}
 	}
 }
 
-func stopRecording(state *RecordingState) {
-	state.mu.Lock()
-	defer state.mu.Unlock()
-	if state.isRecording {
-		state.stopChan <- struct{}{}
-		state.isRecording = false
+// sendSegment sends a recorded segment. The legacy backend gets a WAV file
+// and nothing else; otherwise the segment goes through the outbox, which
+// tags it with an ID and keeps it until the backend acks it.
+func sendSegment(stream *mediastream.Stream, outbox *mediastream.Outbox, protocol string, wavFile []byte) error {
+	samples, sampleRate, err := mediastream.ReadWAV(wavFile)
+	if err != nil {
+		return err
+	}
+	if protocol == "legacy" {
+		return stream.SendSegment(samples, sampleRate)
+	}
+	seg, err := outbox.Send(samples, sampleRate)
+	if err == nil {
+		log.Printf("Sent segment %s", seg.ID)
 	}
+	return err
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	player "github.com/killinsun/voice-conversation-ai/go_mic_streamer/player"
+)
+
+// Usage:
+//
+//	go run ./cmd/voicevox_dict -lexicon lexicon.csv -dry-run
+func main() {
+	voicevoxEndpoints := flag.String("voicevox", "http://localhost:50021", "comma separated VOICEVOX engine endpoints")
+	lexiconPath := flag.String("lexicon", "lexicon.csv", "CSV or YAML lexicon to sync")
+	dryRun := flag.Bool("dry-run", false, "print the changes without applying them")
+	prune := flag.Bool("prune", false, "delete engine words missing from the lexicon")
+	flag.Parse()
+
+	lexicon, err := player.LoadLexicon(*lexiconPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	vc := player.NewVoicevoxClient(strings.Split(*voicevoxEndpoints, ","), 10*time.Second, 2)
+	result, syncErr := player.SyncUserDict(context.Background(), vc, lexicon, *prune, *dryRun)
+	for endpoint, changes := range result {
+		fmt.Printf("%s: %d change(s)\n", endpoint, len(changes))
+		for _, c := range changes {
+			fmt.Println("  " + c.String())
+		}
+	}
+	if syncErr != nil {
+		log.Fatal(syncErr)
+	}
+	if *dryRun {
+		fmt.Println("dry run: nothing was applied")
+	}
+}
@@ -0,0 +1,59 @@
+package conversation
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionBudget limits how long a session may last. OnWarning is called once
+// Warning has elapsed, with the time left until Limit; OnLimit is called when
+// Limit is reached. A zero Warning or Limit disables that callback, and
+// without a Limit there is nothing to warn about.
+type SessionBudget struct {
+	Warning   time.Duration
+	Limit     time.Duration
+	OnWarning func(remaining time.Duration)
+	OnLimit   func()
+	timers    []*time.Timer
+	mu        sync.Mutex
+}
+
+func NewSessionBudget(warning time.Duration, limit time.Duration) *SessionBudget {
+	return &SessionBudget{
+		Warning: warning,
+		Limit:   limit,
+	}
+}
+
+func (b *SessionBudget) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stop()
+	if b.Warning > 0 && b.Limit > 0 && b.Warning < b.Limit {
+		b.timers = append(b.timers, time.AfterFunc(b.Warning, func() {
+			if b.OnWarning != nil {
+				b.OnWarning(b.Limit - b.Warning)
+			}
+		}))
+	}
+	if b.Limit > 0 {
+		b.timers = append(b.timers, time.AfterFunc(b.Limit, func() {
+			if b.OnLimit != nil {
+				b.OnLimit()
+			}
+		}))
+	}
+}
+
+func (b *SessionBudget) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stop()
+}
+
+func (b *SessionBudget) stop() {
+	for _, t := range b.timers {
+		t.Stop()
+	}
+	b.timers = nil
+}
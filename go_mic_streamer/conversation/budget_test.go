@@ -0,0 +1,81 @@
+package conversation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionBudget(t *testing.T) {
+	t.Run("Should warn before the limit", func(t *testing.T) {
+		events := make(chan string, 2)
+		b := NewSessionBudget(10*time.Millisecond, 30*time.Millisecond)
+		var remaining time.Duration
+		b.OnWarning = func(d time.Duration) {
+			remaining = d
+			events <- "warning"
+		}
+		b.OnLimit = func() { events <- "limit" }
+
+		b.Start()
+		defer b.Stop()
+
+		for _, want := range []string{"warning", "limit"} {
+			select {
+			case got := <-events:
+				if got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s was not called", want)
+			}
+		}
+		if remaining != 20*time.Millisecond {
+			t.Errorf("got remaining %v, want 20ms", remaining)
+		}
+	})
+
+	t.Run("Should not fire after Stop", func(t *testing.T) {
+		fired := make(chan struct{}, 2)
+		b := NewSessionBudget(10*time.Millisecond, 20*time.Millisecond)
+		b.OnWarning = func(time.Duration) { fired <- struct{}{} }
+		b.OnLimit = func() { fired <- struct{}{} }
+
+		b.Start()
+		b.Stop()
+		time.Sleep(40 * time.Millisecond)
+
+		if len(fired) != 0 {
+			t.Errorf("got %d callbacks after Stop", len(fired))
+		}
+	})
+
+	t.Run("Should skip a warning that is not before the limit", func(t *testing.T) {
+		warned := false
+		limit := make(chan struct{})
+		b := NewSessionBudget(20*time.Millisecond, 10*time.Millisecond)
+		b.OnWarning = func(time.Duration) { warned = true }
+		b.OnLimit = func() { close(limit) }
+
+		b.Start()
+		<-limit
+		time.Sleep(20 * time.Millisecond)
+
+		if warned {
+			t.Error("warning fired after the limit")
+		}
+	})
+
+	t.Run("Should not warn without a limit", func(t *testing.T) {
+		warned := false
+		b := NewSessionBudget(10*time.Millisecond, 0)
+		b.OnWarning = func(time.Duration) { warned = true }
+
+		b.Start()
+		time.Sleep(30 * time.Millisecond)
+		b.Stop()
+
+		if warned {
+			t.Error("warning fired without a limit")
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package conversation
+
+import (
+	"sync"
+	"time"
+)
+
+// Transition is passed to observers after the state changed (or, for
+// self-transitions such as a repeated timeout, was re-entered).
+type Transition struct {
+	From  State
+	To    State
+	Event Event
+	At    time.Time
+}
+
+type Observer func(Transition)
+
+// Machine is the turn-taking state machine that drives the recorder and the
+// player. Fire never blocks on other goroutines: events are queued, and the
+// goroutine that finds the queue idle processes it, calling observers outside
+// the lock. Observers may Fire further events; they are handled in order
+// after the current one.
+type Machine struct {
+	state     State
+	timeouts  map[State]stateTimeout
+	timer     *time.Timer
+	timerGen  int
+	observers []Observer
+	queue     []Event
+	draining  bool
+	now       func() time.Time
+	mu        sync.Mutex
+}
+
+func NewMachine() *Machine {
+	return &Machine{
+		state:    Idle,
+		timeouts: map[State]stateTimeout{},
+		now:      time.Now,
+	}
+}
+
+type stateTimeout struct {
+	d    time.Duration
+	from []State
+}
+
+// SetTimeout makes the machine fire EventTimeout when it stays in state for d.
+// Re-entering a state restarts its timer. A zero d removes the timeout.
+func (m *Machine) SetTimeout(state State, d time.Duration) {
+	m.SetTimeoutFrom(state, d)
+}
+
+// SetTimeoutFrom is like SetTimeout, but the timer only starts when state is
+// entered from one of from. Without from, every entry starts it.
+func (m *Machine) SetTimeoutFrom(state State, d time.Duration, from ...State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d <= 0 {
+		delete(m.timeouts, state)
+		return
+	}
+	m.timeouts[state] = stateTimeout{d: d, from: from}
+}
+
+func (m *Machine) Observe(o Observer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, o)
+}
+
+func (m *Machine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *Machine) Fire(ev Event) {
+	m.mu.Lock()
+	m.enqueue(ev)
+}
+
+// enqueue must be called with mu held and releases it.
+func (m *Machine) enqueue(ev Event) {
+	m.queue = append(m.queue, ev)
+	if m.draining {
+		m.mu.Unlock()
+		return
+	}
+	m.draining = true
+	m.mu.Unlock()
+
+	m.drain()
+}
+
+func (m *Machine) drain() {
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			m.draining = false
+			m.mu.Unlock()
+			return
+		}
+		ev := m.queue[0]
+		m.queue = m.queue[1:]
+
+		to, ok := transitions[transitionKey{m.state, ev}]
+		if !ok {
+			m.mu.Unlock()
+			continue
+		}
+		t := Transition{From: m.state, To: to, Event: ev, At: m.now()}
+		m.state = to
+		m.resetTimer(t.From, to)
+		observers := append([]Observer{}, m.observers...)
+		m.mu.Unlock()
+
+		for _, o := range observers {
+			o(t)
+		}
+	}
+}
+
+// resetTimer must be called with mu held. The generation counter makes a
+// timer that already fired for a previous state a no-op.
+func (m *Machine) resetTimer(from State, state State) {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.timerGen++
+	timeout, ok := m.timeouts[state]
+	if !ok || state == Ended || !timeout.armedFrom(from) {
+		return
+	}
+	gen := m.timerGen
+	m.timer = time.AfterFunc(timeout.d, func() {
+		m.mu.Lock()
+		if gen != m.timerGen {
+			m.mu.Unlock()
+			return
+		}
+		m.enqueue(EventTimeout)
+	})
+}
+
+func (t stateTimeout) armedFrom(from State) bool {
+	if len(t.from) == 0 {
+		return true
+	}
+	for _, s := range t.from {
+		if s == from {
+			return true
+		}
+	}
+	return false
+}
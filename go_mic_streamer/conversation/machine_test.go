@@ -0,0 +1,186 @@
+package conversation
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMachine(t *testing.T) {
+	t.Run("Should follow a full turn", func(t *testing.T) {
+		m := NewMachine()
+		var got []State
+		m.Observe(func(tr Transition) { got = append(got, tr.To) })
+
+		for _, ev := range []Event{EventStart, EventSpeechStarted, EventSegmentSent, EventReplyReceived, EventPlaybackFinished, EventHangup} {
+			m.Fire(ev)
+		}
+
+		want := []State{Listening, UserSpeaking, WaitingForReply, Speaking, Listening, Ended}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Should ignore events that are not allowed", func(t *testing.T) {
+		m := NewMachine()
+		m.Fire(EventSegmentSent)
+		m.Fire(EventPlaybackFinished)
+
+		if got := m.State(); got != Idle {
+			t.Errorf("got %v, want %v", got, Idle)
+		}
+	})
+
+	t.Run("Should go to Interrupted on barge-in", func(t *testing.T) {
+		m := NewMachine()
+		m.Fire(EventReplyReceived)
+		m.Fire(EventBargeIn)
+		m.Fire(EventSpeechStarted)
+
+		if got := m.State(); got != UserSpeaking {
+			t.Errorf("got %v, want %v", got, UserSpeaking)
+		}
+	})
+
+	t.Run("Should wait for a reply after a key press", func(t *testing.T) {
+		m := NewMachine()
+		m.Fire(EventStart)
+		m.Fire(EventDTMF)
+
+		if got := m.State(); got != WaitingForReply {
+			t.Errorf("got %v, want %v", got, WaitingForReply)
+		}
+	})
+
+	t.Run("Should stop waiting for a reply when the connection is lost", func(t *testing.T) {
+		m := NewMachine()
+		m.Fire(EventStart)
+		m.Fire(EventSpeechStarted)
+		m.Fire(EventSegmentSent)
+		m.Fire(EventDisconnected)
+
+		if got := m.State(); got != Listening {
+			t.Errorf("got %v, want %v", got, Listening)
+		}
+	})
+
+	t.Run("Should handle events fired by observers in order", func(t *testing.T) {
+		m := NewMachine()
+		var got []Event
+		m.Observe(func(tr Transition) {
+			got = append(got, tr.Event)
+			if tr.To == Speaking {
+				m.Fire(EventPlaybackFinished)
+			}
+		})
+
+		m.Fire(EventStart)
+		m.Fire(EventReplyReceived)
+
+		want := []Event{EventStart, EventReplyReceived, EventPlaybackFinished}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Should fire a timeout when a state lasts too long", func(t *testing.T) {
+		m := NewMachine()
+		m.SetTimeout(WaitingForReply, 20*time.Millisecond)
+		done := make(chan Transition, 1)
+		m.Observe(func(tr Transition) {
+			if tr.Event == EventTimeout {
+				done <- tr
+			}
+		})
+
+		m.Fire(EventStart)
+		m.Fire(EventSpeechStarted)
+		m.Fire(EventSegmentSent)
+
+		select {
+		case tr := <-done:
+			if tr.From != WaitingForReply || tr.To != Listening {
+				t.Errorf("got %v -> %v", tr.From, tr.To)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout was not fired")
+		}
+	})
+
+	t.Run("Should cancel the timeout when the state is left", func(t *testing.T) {
+		m := NewMachine()
+		m.SetTimeout(WaitingForReply, 20*time.Millisecond)
+		var mu sync.Mutex
+		timedOut := false
+		m.Observe(func(tr Transition) {
+			mu.Lock()
+			defer mu.Unlock()
+			if tr.Event == EventTimeout {
+				timedOut = true
+			}
+		})
+
+		m.Fire(EventStart)
+		m.Fire(EventSpeechStarted)
+		m.Fire(EventSegmentSent)
+		m.Fire(EventReplyReceived)
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if timedOut {
+			t.Error("timeout fired after leaving the state")
+		}
+	})
+
+	t.Run("Should arm a timeout only when entered from the given states", func(t *testing.T) {
+		m := NewMachine()
+		m.SetTimeoutFrom(Listening, 20*time.Millisecond, Speaking)
+		done := make(chan Transition, 1)
+		m.Observe(func(tr Transition) {
+			if tr.Event == EventTimeout {
+				done <- tr
+			}
+		})
+
+		m.Fire(EventStart)
+		select {
+		case <-done:
+			t.Fatal("timeout fired after EventStart")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		m.Fire(EventReplyReceived)
+		m.Fire(EventPlaybackFinished)
+		select {
+		case tr := <-done:
+			if tr.From != Listening {
+				t.Errorf("got timeout from %v", tr.From)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout was not fired after Speaking")
+		}
+	})
+
+	t.Run("Should not deadlock when fired concurrently", func(t *testing.T) {
+		m := NewMachine()
+		m.Fire(EventStart)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				m.Fire(EventSpeechStarted)
+				m.Fire(EventSegmentSent)
+			}()
+			go func() {
+				defer wg.Done()
+				m.Fire(EventReplyReceived)
+				m.Fire(EventPlaybackFinished)
+			}()
+		}
+		wg.Wait()
+	})
+}
@@ -0,0 +1,51 @@
+package conversation
+
+import "sync"
+
+// NoInputWatcher counts how many times in a row the user stayed silent for the
+// whole Listening timeout. Register its Observe method with Machine.Observe.
+// Talking or pressing a key resets the count.
+type NoInputWatcher struct {
+	// Max is the number of consecutive no-inputs after which OnGiveUp is
+	// called instead of OnNoInput.
+	Max       int
+	OnNoInput func(count int)
+	OnGiveUp  func()
+	count     int
+	mu        sync.Mutex
+}
+
+func NewNoInputWatcher(max int, onNoInput func(count int), onGiveUp func()) *NoInputWatcher {
+	return &NoInputWatcher{
+		Max:       max,
+		OnNoInput: onNoInput,
+		OnGiveUp:  onGiveUp,
+	}
+}
+
+func (w *NoInputWatcher) Observe(t Transition) {
+	w.mu.Lock()
+	switch {
+	case t.Event == EventSpeechStarted || t.Event == EventDTMF:
+		w.count = 0
+		w.mu.Unlock()
+		return
+	case t.Event != EventTimeout || t.From != Listening:
+		w.mu.Unlock()
+		return
+	}
+	w.count++
+	count := w.count
+	giveUp := w.Max > 0 && count >= w.Max
+	w.mu.Unlock()
+
+	if giveUp {
+		if w.OnGiveUp != nil {
+			w.OnGiveUp()
+		}
+		return
+	}
+	if w.OnNoInput != nil {
+		w.OnNoInput(count)
+	}
+}
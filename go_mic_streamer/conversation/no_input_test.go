@@ -0,0 +1,74 @@
+package conversation
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNoInputWatcher(t *testing.T) {
+	timeout := Transition{From: Listening, To: Listening, Event: EventTimeout}
+
+	t.Run("Should give up after Max consecutive no-inputs", func(t *testing.T) {
+		var counts []int
+		gaveUp := 0
+		w := NewNoInputWatcher(3, func(count int) { counts = append(counts, count) }, func() { gaveUp++ })
+
+		w.Observe(timeout)
+		w.Observe(timeout)
+		w.Observe(timeout)
+
+		if !reflect.DeepEqual(counts, []int{1, 2}) {
+			t.Errorf("got %v, want [1 2]", counts)
+		}
+		if gaveUp != 1 {
+			t.Errorf("got %d give-ups, want 1", gaveUp)
+		}
+	})
+
+	t.Run("Should reset the count when the user talks", func(t *testing.T) {
+		var counts []int
+		w := NewNoInputWatcher(3, func(count int) { counts = append(counts, count) }, nil)
+
+		w.Observe(timeout)
+		w.Observe(Transition{From: Listening, To: UserSpeaking, Event: EventSpeechStarted})
+		w.Observe(timeout)
+
+		if !reflect.DeepEqual(counts, []int{1, 1}) {
+			t.Errorf("got %v, want [1 1]", counts)
+		}
+	})
+
+	t.Run("Should ignore a reply timeout", func(t *testing.T) {
+		called := false
+		w := NewNoInputWatcher(1, func(int) { called = true }, func() { called = true })
+
+		w.Observe(Transition{From: WaitingForReply, To: Listening, Event: EventTimeout})
+
+		if called {
+			t.Error("reply timeout was counted as no-input")
+		}
+	})
+
+	t.Run("Should count Listening timeouts of a machine", func(t *testing.T) {
+		done := make(chan int, 3)
+		m := NewMachine()
+		m.SetTimeout(Listening, 10*time.Millisecond)
+		w := NewNoInputWatcher(0, func(count int) { done <- count }, nil)
+		m.Observe(w.Observe)
+
+		m.Fire(EventStart)
+
+		for want := 1; want <= 2; want++ {
+			select {
+			case got := <-done:
+				if got != want {
+					t.Errorf("got %d, want %d", got, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no-input was not reported")
+			}
+		}
+		m.Fire(EventHangup)
+	})
+}
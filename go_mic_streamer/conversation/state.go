@@ -0,0 +1,103 @@
+package conversation
+
+type State int
+
+const (
+	Idle State = iota
+	Listening
+	UserSpeaking
+	WaitingForReply
+	Speaking
+	Interrupted
+	Ended
+)
+
+func (s State) String() string {
+	switch s {
+	case Idle:
+		return "Idle"
+	case Listening:
+		return "Listening"
+	case UserSpeaking:
+		return "UserSpeaking"
+	case WaitingForReply:
+		return "WaitingForReply"
+	case Speaking:
+		return "Speaking"
+	case Interrupted:
+		return "Interrupted"
+	case Ended:
+		return "Ended"
+	}
+	return "Unknown"
+}
+
+type Event string
+
+const (
+	// EventStart begins the conversation.
+	EventStart Event = "start"
+	// EventSpeechStarted is raised by the recorder when the user starts talking.
+	EventSpeechStarted Event = "speech_started"
+	// EventSegmentSent is raised when a finished segment was sent to the backend.
+	EventSegmentSent Event = "segment_sent"
+	// EventSegmentDropped is raised when the recorder gave up on a segment.
+	EventSegmentDropped Event = "segment_dropped"
+	// EventDTMF is raised when the user pressed a key; the digit was sent to the backend.
+	EventDTMF Event = "dtmf"
+	// EventReplyReceived is raised when the backend sends something to say.
+	EventReplyReceived Event = "reply_received"
+	// EventPlaybackFinished is raised when the player is done with a reply.
+	EventPlaybackFinished Event = "playback_finished"
+	// EventBargeIn is raised when the user talks over the AI.
+	EventBargeIn Event = "barge_in"
+	// EventDisconnected is raised when the connection to the backend dropped
+	// and nothing that was sent is left to send again after a reconnect, so a
+	// reply that was being waited for will not come.
+	EventDisconnected Event = "disconnected"
+	// EventTimeout is raised by the machine when a state's timeout expires.
+	EventTimeout Event = "timeout"
+	// EventHangup ends the conversation from any state.
+	EventHangup Event = "hangup"
+)
+
+type transitionKey struct {
+	from  State
+	event Event
+}
+
+// transitions lists every allowed transition. Events not listed for the
+// current state are ignored.
+var transitions = map[transitionKey]State{
+	{Idle, EventStart}:                    Listening,
+	{Idle, EventReplyReceived}:            Speaking,
+	{Listening, EventSpeechStarted}:       UserSpeaking,
+	{Listening, EventReplyReceived}:       Speaking,
+	{Listening, EventTimeout}:             Listening,
+	{UserSpeaking, EventSegmentSent}:      WaitingForReply,
+	{UserSpeaking, EventSegmentDropped}:   Listening,
+	{UserSpeaking, EventReplyReceived}:    Speaking,
+	{UserSpeaking, EventTimeout}:          Listening,
+	{Listening, EventDTMF}:                WaitingForReply,
+	{UserSpeaking, EventDTMF}:             WaitingForReply,
+	{WaitingForReply, EventDTMF}:          WaitingForReply,
+	{Interrupted, EventDTMF}:              WaitingForReply,
+	{WaitingForReply, EventSpeechStarted}: UserSpeaking,
+	{WaitingForReply, EventReplyReceived}: Speaking,
+	{WaitingForReply, EventTimeout}:       Listening,
+	{WaitingForReply, EventDisconnected}:  Listening,
+	{Speaking, EventPlaybackFinished}:     Listening,
+	{Speaking, EventBargeIn}:              Interrupted,
+	{Speaking, EventReplyReceived}:        Speaking,
+	{Interrupted, EventSpeechStarted}:     UserSpeaking,
+	{Interrupted, EventSegmentSent}:       WaitingForReply,
+	{Interrupted, EventPlaybackFinished}:  Interrupted,
+	{Interrupted, EventReplyReceived}:     Speaking,
+	{Interrupted, EventTimeout}:           Listening,
+	{Idle, EventHangup}:                   Ended,
+	{Listening, EventHangup}:              Ended,
+	{UserSpeaking, EventHangup}:           Ended,
+	{WaitingForReply, EventHangup}:        Ended,
+	{Speaking, EventHangup}:               Ended,
+	{Interrupted, EventHangup}:            Ended,
+}
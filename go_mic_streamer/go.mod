@@ -4,11 +4,11 @@ go 1.19
 
 require (
 	github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5
+	github.com/hajimehoshi/oto v0.7.1
 	github.com/youpy/go-wav v0.3.2
 )
 
 require (
-	github.com/hajimehoshi/oto v0.7.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/exp v0.0.0-20190306152737-a1d7652674e8 // indirect
 	golang.org/x/image v0.0.0-20190227222117-0694c2d4d067 // indirect
@@ -19,6 +19,6 @@ require (
 require (
 	github.com/faiface/beep v1.1.0
 	github.com/youpy/go-riff v0.1.0 // indirect
-	github.com/zaf/g711 v0.0.0-20190814101024-76a4a538f52b // indirect
+	github.com/zaf/g711 v0.0.0-20190814101024-76a4a538f52b
 	golang.org/x/net v0.24.0
 )
@@ -0,0 +1,268 @@
+package mediastream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/youpy/go-wav"
+	"github.com/zaf/g711"
+)
+
+// Codec is the audio encoding of a connection's media payloads.
+type Codec struct {
+	// ID identifies the codec in binary frame headers.
+	ID   byte
+	Name string
+	// Encoding is the MIME type announced in the start message.
+	Encoding   string
+	SampleRate int
+	// FormatTag is the WAVE format tag: 1 PCM, 6 A-law, 7 μ-law.
+	FormatTag      uint16
+	BytesPerSample int
+	// Silence is the encoded value of a zero sample.
+	Silence byte
+	Encode  func([]int16) []byte
+	Decode  func([]byte) []int16
+}
+
+var (
+	Mulaw = Codec{ID: 1, Name: "mulaw", Encoding: "audio/x-mulaw", SampleRate: 8000, FormatTag: wav.AudioFormatMULaw, BytesPerSample: 1, Silence: 0xff, Encode: EncodeUlaw, Decode: DecodeUlaw}
+	Alaw  = Codec{ID: 2, Name: "alaw", Encoding: "audio/x-alaw", SampleRate: 8000, FormatTag: wav.AudioFormatALaw, BytesPerSample: 1, Silence: 0xd5, Encode: EncodeAlaw, Decode: DecodeAlaw}
+	// L16 is 16kHz linear PCM (little endian), what the recorder captures.
+	L16 = Codec{ID: 3, Name: "l16", Encoding: "audio/l16", SampleRate: 16000, FormatTag: wav.AudioFormatPCM, BytesPerSample: 2, Encode: encodeL16, Decode: decodeL16}
+)
+
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "mulaw", "ulaw", "pcmu":
+		return Mulaw, nil
+	case "alaw", "pcma":
+		return Alaw, nil
+	case "l16", "pcm":
+		return L16, nil
+	}
+	return Codec{}, fmt.Errorf("unknown codec %q", name)
+}
+
+// CodecByEncoding returns the codec announced as encoding in a start message.
+func CodecByEncoding(encoding string) (Codec, error) {
+	for _, c := range []Codec{Mulaw, Alaw, L16} {
+		if c.Encoding == encoding {
+			return c, nil
+		}
+	}
+	return Codec{}, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// EncodeUlaw converts 16-bit samples to G.711 μ-law.
+func EncodeUlaw(samples []int16) []byte {
+	out := make([]byte, len(samples))
+	for i, s := range samples {
+		out[i] = g711.EncodeUlawFrame(s)
+	}
+	return out
+}
+
+func DecodeUlaw(b []byte) []int16 {
+	out := make([]int16, len(b))
+	for i, v := range b {
+		out[i] = g711.DecodeUlawFrame(v)
+	}
+	return out
+}
+
+func EncodeAlaw(samples []int16) []byte {
+	out := make([]byte, len(samples))
+	for i, s := range samples {
+		out[i] = g711.EncodeAlawFrame(s)
+	}
+	return out
+}
+
+func DecodeAlaw(b []byte) []int16 {
+	out := make([]int16, len(b))
+	for i, v := range b {
+		out[i] = g711.DecodeAlawFrame(v)
+	}
+	return out
+}
+
+func encodeL16(samples []int16) []byte {
+	out := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(s))
+	}
+	return out
+}
+
+func decodeL16(b []byte) []int16 {
+	out := make([]int16, len(b)/2)
+	for i := range out {
+		out[i] = int16(binary.LittleEndian.Uint16(b[i*2:]))
+	}
+	return out
+}
+
+// Resample converts mono samples between rates with a windowed-sinc
+// interpolator. When downsampling, the cutoff is lowered below the new
+// Nyquist frequency so speech does not alias.
+func Resample(samples []int16, from int, to int) []int16 {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+	ratio := float64(to) / float64(from)
+	cutoff := 0.95
+	if ratio < 1 {
+		cutoff *= ratio
+	}
+	// 片側のタップ数。カットオフが低いほど長いフィルタが要る
+	half := int(math.Ceil(8 / cutoff))
+
+	outLen := int(int64(len(samples)) * int64(to) / int64(from))
+	out := make([]int16, outLen)
+	for i := range out {
+		pos := float64(i) / ratio
+		center := int(pos)
+		var sum, weight float64
+		for k := center - half + 1; k <= center+half; k++ {
+			if k < 0 || k >= len(samples) {
+				continue
+			}
+			x := pos - float64(k)
+			w := cutoff * sinc(cutoff*x) * blackman(x, half)
+			sum += float64(samples[k]) * w
+			weight += w
+		}
+		if weight != 0 {
+			// 端でタップが欠けても DC ゲインが 1 になるよう正規化する
+			sum /= weight
+		}
+		out[i] = clamp16(sum)
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is a Blackman window over [-half, half].
+func blackman(x float64, half int) float64 {
+	t := (x + float64(half)) / float64(2*half)
+	if t < 0 || t > 1 {
+		return 0
+	}
+	return 0.42 - 0.5*math.Cos(2*math.Pi*t) + 0.08*math.Cos(4*math.Pi*t)
+}
+
+func clamp16(v float64) int16 {
+	v = math.Round(v)
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
+
+// EncodeWAV resamples mono samples to the codec's rate and wraps them in a
+// WAV file with the codec's format tag. G.711 files carry the extended fmt
+// chunk and the fact chunk that non-PCM WAVE files require, and odd-length
+// data is followed by the pad byte RIFF chunks need.
+func EncodeWAV(samples []int16, sampleRate int, codec Codec) []byte {
+	data := codec.Encode(Resample(samples, sampleRate, codec.SampleRate))
+	pcm := codec.FormatTag == wav.AudioFormatPCM
+
+	fmtSize := uint32(16)
+	if !pcm {
+		fmtSize = 18
+	}
+	pad := len(data) % 2
+	size := 4 + (8 + fmtSize) + (8 + uint32(len(data)+pad))
+	if !pcm {
+		size += 8 + 4
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 8+size))
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, size)
+	buf.WriteString("WAVEfmt ")
+	binary.Write(buf, binary.LittleEndian, fmtSize)
+	binary.Write(buf, binary.LittleEndian, codec.FormatTag)
+	binary.Write(buf, binary.LittleEndian, uint16(1))
+	binary.Write(buf, binary.LittleEndian, uint32(codec.SampleRate))
+	binary.Write(buf, binary.LittleEndian, uint32(codec.SampleRate*codec.BytesPerSample))
+	binary.Write(buf, binary.LittleEndian, uint16(codec.BytesPerSample))
+	binary.Write(buf, binary.LittleEndian, uint16(codec.BytesPerSample*8))
+	if !pcm {
+		binary.Write(buf, binary.LittleEndian, uint16(0))
+		buf.WriteString("fact")
+		binary.Write(buf, binary.LittleEndian, uint32(4))
+		binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	}
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if pad != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// wavDataSize returns the size recorded in the header of the data chunk.
+func wavDataSize(b []byte) (int, bool) {
+	for pos := 12; pos+8 <= len(b); {
+		size := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		if string(b[pos:pos+4]) == "data" {
+			return size, true
+		}
+		pos += 8 + size + size%2
+	}
+	return 0, false
+}
+
+// ReadWAV returns the first channel of a 16-bit PCM, μ-law or A-law WAV file
+// as linear samples, and its sample rate.
+func ReadWAV(b []byte) ([]int16, int, error) {
+	r := wav.NewReader(bytes.NewReader(b))
+	format, err := r.Format()
+	if err != nil {
+		return nil, 0, err
+	}
+	var decode func([]byte) []int16
+	switch {
+	case format.AudioFormat == wav.AudioFormatPCM && format.BitsPerSample == 16:
+		decode = decodeL16
+	case format.AudioFormat == wav.AudioFormatMULaw && format.BitsPerSample == 8:
+		decode = DecodeUlaw
+	case format.AudioFormat == wav.AudioFormatALaw && format.BitsPerSample == 8:
+		decode = DecodeAlaw
+	default:
+		return nil, 0, fmt.Errorf("unsupported wav format %d/%d bit", format.AudioFormat, format.BitsPerSample)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	// go-wav は奇数長のデータにパディングを含めて返すので、本来の長さに切る
+	if size, ok := wavDataSize(b); ok && len(data) > size {
+		data = data[:size]
+	}
+	samples := decode(data)
+	channels := int(format.NumChannels)
+	if channels > 1 {
+		mono := make([]int16, len(samples)/channels)
+		for i := range mono {
+			mono[i] = samples[i*channels]
+		}
+		samples = mono
+	}
+	return samples, int(format.SampleRate), nil
+}
@@ -0,0 +1,143 @@
+package mediastream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func sine(freq float64, rate int, n int, amplitude float64) []int16 {
+	out := make([]int16, n)
+	for i := range out {
+		out[i] = int16(amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return out
+}
+
+func rms(samples []int16) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func TestUlaw(t *testing.T) {
+	t.Run("Should round trip within the quantization error", func(t *testing.T) {
+		in := sine(440, 8000, 800, 20000)
+		out := DecodeUlaw(EncodeUlaw(in))
+		for i := range in {
+			// μ-law の量子化誤差は振幅のおよそ 3% 以内
+			if diff := math.Abs(float64(in[i]) - float64(out[i])); diff > math.Abs(float64(in[i]))*0.04+8 {
+				t.Fatalf("sample %d: got %d, want about %d", i, out[i], in[i])
+			}
+		}
+	})
+}
+
+func TestResample(t *testing.T) {
+	t.Run("Should keep speech band tones", func(t *testing.T) {
+		in := sine(1000, 16000, 16000, 10000)
+		out := Resample(in, 16000, 8000)
+
+		if len(out) != 8000 {
+			t.Fatalf("got %d samples, want 8000", len(out))
+		}
+		want := sine(1000, 8000, 8000, 10000)
+		// 端はフィルタの影響があるので中央で比較する
+		for i := 100; i < len(out)-100; i++ {
+			if diff := math.Abs(float64(out[i] - want[i])); diff > 200 {
+				t.Fatalf("sample %d: got %d, want %d", i, out[i], want[i])
+			}
+		}
+	})
+
+	t.Run("Should filter out tones above the new Nyquist frequency", func(t *testing.T) {
+		in := sine(6000, 16000, 16000, 10000)
+		out := Resample(in, 16000, 8000)
+
+		if got := rms(out[100 : len(out)-100]); got > 100 {
+			t.Errorf("got rms %v, want an aliased 6kHz tone to be filtered", got)
+		}
+	})
+}
+
+func TestWAV(t *testing.T) {
+	for _, codec := range []Codec{Mulaw, Alaw, L16} {
+		t.Run("Should write and read back "+codec.Name, func(t *testing.T) {
+			in := sine(440, 16000, 16000, 12000)
+			b := EncodeWAV(in, 16000, codec)
+
+			if got := binary.LittleEndian.Uint16(b[20:]); got != codec.FormatTag {
+				t.Errorf("got format tag %d, want %d", got, codec.FormatTag)
+			}
+			if got := string(b[8:12]); got != "WAVE" {
+				t.Errorf("got %q, want WAVE", got)
+			}
+			if got := binary.LittleEndian.Uint32(b[4:]); int(got) != len(b)-8 {
+				t.Errorf("got RIFF size %d, want %d", got, len(b)-8)
+			}
+
+			out, rate, err := ReadWAV(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rate != codec.SampleRate {
+				t.Errorf("got %dHz, want %dHz", rate, codec.SampleRate)
+			}
+			if len(out) != codec.SampleRate {
+				t.Fatalf("got %d samples, want %d", len(out), codec.SampleRate)
+			}
+			want := rms(sine(440, codec.SampleRate, codec.SampleRate, 12000))
+			if got := rms(out); math.Abs(got-want) > want*0.02 {
+				t.Errorf("got rms %v, want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("Should carry a fact chunk for G.711", func(t *testing.T) {
+		b := EncodeWAV(make([]int16, 1600), 16000, Alaw)
+		if !bytes.Contains(b, []byte("fact")) {
+			t.Error("fact chunk is missing")
+		}
+		if n := len(b); n != 58+800 {
+			t.Errorf("got %d bytes, want %d", n, 58+800)
+		}
+	})
+
+	t.Run("Should pad odd-length G.711 data", func(t *testing.T) {
+		b := EncodeWAV(make([]int16, 801), 8000, Mulaw)
+
+		if len(b) != 58+802 {
+			t.Errorf("got %d bytes, want %d", len(b), 58+802)
+		}
+		if got := binary.LittleEndian.Uint32(b[4:]); int(got) != len(b)-8 {
+			t.Errorf("got RIFF size %d, want %d", got, len(b)-8)
+		}
+		if got := binary.LittleEndian.Uint32(b[len(b)-806:]); got != 801 {
+			t.Errorf("got data size %d, want 801", got)
+		}
+		out, _, err := ReadWAV(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 801 {
+			t.Errorf("got %d samples, want 801", len(out))
+		}
+	})
+}
+
+func TestCodecByName(t *testing.T) {
+	t.Run("Should accept common aliases", func(t *testing.T) {
+		for name, want := range map[string]string{"pcmu": "mulaw", "ulaw": "mulaw", "pcma": "alaw", "pcm": "l16"} {
+			codec, err := CodecByName(name)
+			if err != nil || codec.Name != want {
+				t.Errorf("%s: got %v, %v", name, codec.Name, err)
+			}
+		}
+		if _, err := CodecByName("opus"); err == nil {
+			t.Error("expected an error for opus")
+		}
+	})
+}
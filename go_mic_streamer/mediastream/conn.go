@@ -0,0 +1,371 @@
+package mediastream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	// ErrClosed is returned by Send after Close.
+	ErrClosed = errors.New("connection closed")
+	// ErrNotConnected is returned by Send while the connection is down.
+	ErrNotConnected = errors.New("not connected")
+	// ErrHeartbeatTimeout is passed to OnDisconnect when nothing, not even a
+	// pong, was heard from the backend for HeartbeatTimeout.
+	ErrHeartbeatTimeout = errors.New("no heartbeat from the backend")
+)
+
+// Conn is the websocket connection to the backend. It dials again with
+// exponential backoff and jitter whenever the connection is lost. Send fails
+// while it is down; keeping messages for the next connection is up to the
+// caller, see Stream.
+//
+// Every HeartbeatInterval a ping frame is sent. A connection on which nothing
+// was received for HeartbeatTimeout, pongs included, is taken for dead and
+// dropped. Zero disables either.
+//
+// A write that does not finish within WriteTimeout fails and drops the
+// connection; zero means 10s. Writes do not hold the lock, so a stuck write
+// never holds up Close or the heartbeat.
+type Conn struct {
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	WriteTimeout      time.Duration
+	// ResumeToken is sent in the X-Resume-Token header of every handshake so
+	// the backend can continue the same conversation after a reconnect.
+	ResumeToken string
+	// OnConnect is called on every connection before Send writes to it.
+	// send writes to this connection only, already during OnConnect, and
+	// fails once it is lost. An error drops the connection and dials again.
+	OnConnect    func(ws *websocket.Conn, send Sender, reconnect bool) error
+	OnMessage    func(data []byte)
+	OnDisconnect func(err error)
+	config       *websocket.Config
+	ws           *websocket.Conn
+	written      atomic.Int64
+	closed       bool
+	stop         chan struct{}
+	mu           sync.Mutex
+}
+
+const (
+	defaultWriteTimeout = 10 * time.Second
+	// closeTimeout is how long Close waits for the close frame, and for
+	// writes stuck on the connection to give up.
+	closeTimeout = 500 * time.Millisecond
+)
+
+func NewConn(config *websocket.Config) *Conn {
+	return &Conn{
+		MinBackoff:        500 * time.Millisecond,
+		MaxBackoff:        30 * time.Second,
+		HeartbeatInterval: 10 * time.Second,
+		HeartbeatTimeout:  30 * time.Second,
+		WriteTimeout:      defaultWriteTimeout,
+		ResumeToken:       newSid("RT"),
+		config:            config,
+		stop:              make(chan struct{}),
+	}
+}
+
+// Start connects in the background and keeps reconnecting until Close.
+func (c *Conn) Start() {
+	go c.run()
+}
+
+func (c *Conn) run() {
+	backoff := c.MinBackoff
+	reconnect := false
+	for {
+		ws, activity, err := c.connect(reconnect)
+		if err != nil {
+			// 0.5〜1 倍のジッターで再接続が一斉に集中しないようにする
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			log.Printf("Could not connect to %s: %v, retrying in %v", c.config.Location, err, wait)
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(wait):
+			}
+			if backoff *= 2; backoff > c.MaxBackoff {
+				backoff = c.MaxBackoff
+			}
+			continue
+		}
+		log.Println("Connected to", c.config.Location)
+		backoff = c.MinBackoff
+		reconnect = true
+
+		done := make(chan struct{})
+		dead := make(chan struct{})
+		go c.heartbeat(ws, activity, done, dead)
+		err = c.read(ws)
+		close(done)
+		select {
+		case <-dead:
+			err = ErrHeartbeatTimeout
+		default:
+		}
+		c.mu.Lock()
+		if c.ws == ws {
+			c.ws = nil
+		}
+		closed := c.closed
+		c.mu.Unlock()
+		closeWS(ws)
+		if closed {
+			return
+		}
+		if c.OnDisconnect != nil {
+			c.OnDisconnect(err)
+		}
+	}
+}
+
+func (c *Conn) connect(reconnect bool) (*websocket.Conn, *activityConn, error) {
+	// ハンドシェイクで Protocol が書き換えられるので毎回コピーを使う
+	config := *c.config
+	config.Protocol = append([]string(nil), c.config.Protocol...)
+	config.Header = c.config.Header.Clone()
+	if c.ResumeToken != "" {
+		config.Header.Set("X-Resume-Token", c.ResumeToken)
+	}
+	raw, err := dial(&config)
+	if err != nil {
+		return nil, nil, err
+	}
+	// pong を含め、何か受信したら生きているとみなす
+	activity := &activityConn{Conn: raw, written: &c.written}
+	activity.touch()
+	if c.HeartbeatTimeout > 0 {
+		raw.SetDeadline(time.Now().Add(c.HeartbeatTimeout))
+	}
+	ws, err := websocket.NewClient(&config, activity)
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	raw.SetDeadline(time.Time{})
+
+	if c.OnConnect != nil {
+		send := func(data []byte, binary bool) error {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			err := c.write(ws, data, binary)
+			if err != nil {
+				closeWS(ws)
+			}
+			return err
+		}
+		if err := c.OnConnect(ws, send, reconnect); err != nil {
+			closeWS(ws)
+			return nil, nil, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		closeWS(ws)
+		return nil, nil, ErrClosed
+	}
+	c.ws = ws
+	return ws, activity, nil
+}
+
+// dial opens the TCP (or TLS) connection for config, like websocket.DialConfig
+// does, so that reads can be watched.
+func dial(config *websocket.Config) (net.Conn, error) {
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 10 * time.Second}
+	}
+	host := config.Location.Host
+	switch config.Location.Scheme {
+	case "ws":
+		if config.Location.Port() == "" {
+			host = net.JoinHostPort(config.Location.Hostname(), "80")
+		}
+		return dialer.DialContext(context.Background(), "tcp", host)
+	case "wss":
+		if config.Location.Port() == "" {
+			host = net.JoinHostPort(config.Location.Hostname(), "443")
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: config.TlsConfig}
+		return tlsDialer.DialContext(context.Background(), "tcp", host)
+	}
+	return nil, websocket.ErrBadScheme
+}
+
+// heartbeat pings ws until done and closes it, signalling dead, once it has
+// been silent for HeartbeatTimeout.
+func (c *Conn) heartbeat(ws *websocket.Conn, activity *activityConn, done chan struct{}, dead chan struct{}) {
+	if c.HeartbeatInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.HeartbeatInterval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if c.HeartbeatTimeout > 0 && activity.silence() > c.HeartbeatTimeout {
+			log.Printf("Nothing heard from the backend for %v", activity.silence().Round(time.Second))
+			close(dead)
+			closeWS(ws)
+			return
+		}
+		if err := c.ping(ws, strconv.Itoa(n)); err != nil {
+			log.Println("Error sending ping:", err)
+		}
+	}
+}
+
+// ping sends a ping frame; the server answers with a pong on its own. Only
+// the heartbeat writes with ws.Write, so setting PayloadType is safe.
+func (c *Conn) ping(ws *websocket.Conn, payload string) error {
+	c.setWriteDeadline(ws)
+	ws.PayloadType = websocket.PingFrame
+	_, err := ws.Write([]byte(payload))
+	ws.PayloadType = websocket.TextFrame
+	return err
+}
+
+func (c *Conn) read(ws *websocket.Conn) error {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return err
+		}
+		if c.OnMessage != nil {
+			c.OnMessage(data)
+		}
+	}
+}
+
+// Send writes one message. It is a Sender.
+func (c *Conn) Send(data []byte, binary bool) error {
+	c.mu.Lock()
+	ws, closed := c.ws, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if ws == nil {
+		return ErrNotConnected
+	}
+	err := c.write(ws, data, binary)
+	if err != nil {
+		// 読み込み側に切断を気付かせる
+		closeWS(ws)
+		c.mu.Lock()
+		if c.ws == ws {
+			c.ws = nil
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// BytesWritten is the number of bytes written to the network over all
+// connections: handshakes, websocket framing and pings included.
+func (c *Conn) BytesWritten() int64 {
+	return c.written.Load()
+}
+
+// Connected reports whether Send currently writes to a connection.
+func (c *Conn) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws != nil
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.stop)
+	ws := c.ws
+	c.mu.Unlock()
+	if ws != nil {
+		return closeWS(ws)
+	}
+	return nil
+}
+
+func (c *Conn) write(ws *websocket.Conn, data []byte, binary bool) error {
+	c.setWriteDeadline(ws)
+	if binary {
+		return websocket.Message.Send(ws, data)
+	}
+	return websocket.Message.Send(ws, string(data))
+}
+
+// setWriteDeadline keeps a write from hanging on a half-open connection.
+func (c *Conn) setWriteDeadline(ws *websocket.Conn) {
+	timeout := c.WriteTimeout
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+	ws.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// closeWS closes ws without waiting for a write stuck on it: ws.Close sends
+// the close frame under the same lock as every write, so the deadline is
+// brought forward first.
+func closeWS(ws *websocket.Conn) error {
+	ws.SetWriteDeadline(time.Now().Add(closeTimeout))
+	return ws.Close()
+}
+
+// activityConn remembers when something was last read from the connection
+// and counts the bytes written to it.
+type activityConn struct {
+	net.Conn
+	last    atomic.Int64
+	written *atomic.Int64
+}
+
+func (a *activityConn) Write(b []byte) (int, error) {
+	n, err := a.Conn.Write(b)
+	a.written.Add(int64(n))
+	return n, err
+}
+
+func (a *activityConn) Read(b []byte) (int, error) {
+	n, err := a.Conn.Read(b)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+func (a *activityConn) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activityConn) silence() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
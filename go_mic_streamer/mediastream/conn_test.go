@@ -0,0 +1,249 @@
+package mediastream
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type testServer struct {
+	*httptest.Server
+	messages chan string
+	tokens   chan string
+	// closeAfter drops each connection after this many messages; 0 never does.
+	closeAfter int
+}
+
+func newTestServer(closeAfter int) *testServer {
+	s := &testServer{messages: make(chan string, 100), tokens: make(chan string, 10), closeAfter: closeAfter}
+	s.Server = httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		s.tokens <- ws.Request().Header.Get("X-Resume-Token")
+		for n := 1; ; n++ {
+			var m string
+			if err := websocket.Message.Receive(ws, &m); err != nil {
+				return
+			}
+			s.messages <- m
+			if n == s.closeAfter {
+				ws.Close()
+				return
+			}
+		}
+	}))
+	return s
+}
+
+// newSilentServer accepts connections but never reads from them, so pings go
+// unanswered as on a half-open connection.
+func newSilentServer(t *testing.T) *testServer {
+	s := &testServer{messages: make(chan string, 100), tokens: make(chan string, 10)}
+	release := make(chan struct{})
+	s.Server = httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		s.tokens <- ws.Request().Header.Get("X-Resume-Token")
+		<-release
+	}))
+	t.Cleanup(func() { close(release) })
+	return s
+}
+
+func (s *testServer) conn(t *testing.T) *Conn {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(s.URL, "http"), "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConn(config)
+	c.MinBackoff = 10 * time.Millisecond
+	c.MaxBackoff = 20 * time.Millisecond
+	return c
+}
+
+func (s *testServer) receive(t *testing.T, n int) []string {
+	var got []string
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-s.messages:
+			got = append(got, m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %q, want %d messages", got, n)
+		}
+	}
+	return got
+}
+
+func TestConn(t *testing.T) {
+	t.Run("Should not send before it is connected", func(t *testing.T) {
+		server := newTestServer(0)
+		defer server.Close()
+		c := server.conn(t)
+		defer c.Close()
+		connected := make(chan struct{})
+		c.OnConnect = func(ws *websocket.Conn, send Sender, reconnect bool) error {
+			if err := c.Send([]byte("1"), false); err != ErrNotConnected {
+				t.Errorf("got %v, want ErrNotConnected", err)
+			}
+			close(connected)
+			return send([]byte("hello"), false)
+		}
+
+		if err := c.Send([]byte("1"), false); err != ErrNotConnected {
+			t.Errorf("got %v, want ErrNotConnected", err)
+		}
+		c.Start()
+		<-connected
+		for !c.Connected() {
+			time.Sleep(time.Millisecond)
+		}
+		c.Send([]byte("2"), false)
+
+		if got := strings.Join(server.receive(t, 2), ","); got != "hello,2" {
+			t.Errorf("got %s", got)
+		}
+	})
+
+	t.Run("Should reconnect with the same resume token", func(t *testing.T) {
+		server := newTestServer(2)
+		defer server.Close()
+		c := server.conn(t)
+		defer c.Close()
+		reconnects := make(chan bool, 10)
+		c.OnConnect = func(ws *websocket.Conn, send Sender, reconnect bool) error {
+			reconnects <- reconnect
+			return nil
+		}
+		c.Start()
+
+		if <-reconnects {
+			t.Error("first connection reported as a reconnect")
+		}
+		c.Send([]byte("1"), false)
+		c.Send([]byte("2"), false)
+		server.receive(t, 2)
+		select {
+		case r := <-reconnects:
+			if !r {
+				t.Error("second connection not reported as a reconnect")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("did not reconnect")
+		}
+		if first, second := <-server.tokens, <-server.tokens; first == "" || first != second {
+			t.Errorf("got tokens %q and %q", first, second)
+		}
+	})
+
+	t.Run("Should count the bytes put on the wire", func(t *testing.T) {
+		server := newTestServer(0)
+		defer server.Close()
+		c := server.conn(t)
+		defer c.Close()
+		c.Start()
+		for !c.Connected() {
+			time.Sleep(time.Millisecond)
+		}
+
+		before := c.BytesWritten()
+		c.Send([]byte("hello"), false)
+		server.receive(t, 1)
+
+		if before == 0 {
+			t.Error("the handshake was not counted")
+		}
+		// 2 バイトのヘッダーと 4 バイトのマスクが付く
+		if got := c.BytesWritten() - before; got != 5+6 {
+			t.Errorf("got %d bytes, want %d", got, 5+6)
+		}
+	})
+
+	t.Run("Should close without waiting for a stuck write", func(t *testing.T) {
+		server := newSilentServer(t)
+		defer server.Close()
+		c := server.conn(t)
+		c.HeartbeatTimeout = 0
+		c.WriteTimeout = time.Minute
+		c.Start()
+		for !c.Connected() {
+			time.Sleep(time.Millisecond)
+		}
+		// 読まれないので、そのうち送信バッファが埋まって書き込みが止まる
+		go func() {
+			for c.Send(make([]byte, 1<<20), true) == nil {
+			}
+		}()
+		time.Sleep(200 * time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			c.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Close waited for the stuck write")
+		}
+	})
+
+	t.Run("Should refuse to send after Close", func(t *testing.T) {
+		server := newTestServer(0)
+		defer server.Close()
+		c := server.conn(t)
+		c.Close()
+		if err := c.Send([]byte("1"), false); err != ErrClosed {
+			t.Errorf("got %v, want ErrClosed", err)
+		}
+	})
+}
+
+func TestConnHeartbeat(t *testing.T) {
+	t.Run("Should stay connected while the backend answers pings", func(t *testing.T) {
+		server := newTestServer(0)
+		defer server.Close()
+		c := server.conn(t)
+		defer c.Close()
+		c.HeartbeatInterval = 20 * time.Millisecond
+		c.HeartbeatTimeout = 100 * time.Millisecond
+		disconnected := make(chan error, 10)
+		c.OnDisconnect = func(err error) { disconnected <- err }
+		c.Start()
+
+		select {
+		case err := <-disconnected:
+			t.Errorf("got disconnected: %v", err)
+		case <-time.After(300 * time.Millisecond):
+		}
+		if !c.Connected() {
+			t.Error("not connected")
+		}
+	})
+
+	t.Run("Should drop a silent connection and reconnect", func(t *testing.T) {
+		server := newSilentServer(t)
+		c := server.conn(t)
+		defer server.Close()
+		defer c.Close()
+		c.HeartbeatInterval = 20 * time.Millisecond
+		c.HeartbeatTimeout = 100 * time.Millisecond
+		disconnected := make(chan error, 10)
+		c.OnDisconnect = func(err error) { disconnected <- err }
+		c.Start()
+
+		select {
+		case err := <-disconnected:
+			if err != ErrHeartbeatTimeout {
+				t.Errorf("got %v, want ErrHeartbeatTimeout", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("silent connection was not dropped")
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case <-server.tokens:
+			case <-time.After(2 * time.Second):
+				t.Fatal("did not reconnect")
+			}
+		}
+	})
+}
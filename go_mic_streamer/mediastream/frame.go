@@ -0,0 +1,70 @@
+package mediastream
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Framing selects how media is put on the websocket. Control messages are
+// always JSON text frames.
+type Framing string
+
+const (
+	// FramingJSON sends media as base64 in Twilio "media" messages.
+	FramingJSON Framing = "media-json"
+	// FramingBinary sends media as binary frames: a 16 byte header followed
+	// by the raw codec payload.
+	FramingBinary Framing = "media-binary.v1"
+)
+
+// NegotiateFraming picks the framing from the subprotocol the server chose
+// during the websocket handshake. A server that ignores subprotocols gets JSON.
+func NegotiateFraming(selected []string) Framing {
+	if len(selected) == 1 && Framing(selected[0]) == FramingBinary {
+		return FramingBinary
+	}
+	return FramingJSON
+}
+
+const (
+	FrameMedia   byte = 1
+	FrameSegment byte = 2
+
+	frameHeaderSize = 16
+)
+
+// Frame is a binary media frame. The header is, in network byte order:
+//
+//	type(1) codec(1) reserved(2) sequence(4) chunk(4) timestamp ms(4)
+type Frame struct {
+	Type      byte
+	Codec     byte
+	Sequence  uint32
+	Chunk     uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+func (f *Frame) MarshalBinary() ([]byte, error) {
+	b := make([]byte, frameHeaderSize+len(f.Payload))
+	b[0] = f.Type
+	b[1] = f.Codec
+	binary.BigEndian.PutUint32(b[4:], f.Sequence)
+	binary.BigEndian.PutUint32(b[8:], f.Chunk)
+	binary.BigEndian.PutUint32(b[12:], f.Timestamp)
+	copy(b[frameHeaderSize:], f.Payload)
+	return b, nil
+}
+
+func (f *Frame) UnmarshalBinary(b []byte) error {
+	if len(b) < frameHeaderSize {
+		return fmt.Errorf("binary frame too short: %d bytes", len(b))
+	}
+	f.Type = b[0]
+	f.Codec = b[1]
+	f.Sequence = binary.BigEndian.Uint32(b[4:])
+	f.Chunk = binary.BigEndian.Uint32(b[8:])
+	f.Timestamp = binary.BigEndian.Uint32(b[12:])
+	f.Payload = append([]byte{}, b[frameHeaderSize:]...)
+	return nil
+}
@@ -0,0 +1,200 @@
+package mediastream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// ProtocolVersion is the version of the messages this package adds to Media
+// Streams. The backend answers with the version it speaks, at most this one.
+const ProtocolVersion = 1
+
+const (
+	// EventHello opens a session with what the client can do.
+	EventHello = "hello"
+	// EventWelcome is the backend's answer, choosing among the offers.
+	EventWelcome = "welcome"
+)
+
+// ErrBadWelcome is wrapped by the errors for a welcome that chose something
+// that was not offered. Dialing again will not help.
+var ErrBadWelcome = errors.New("bad welcome")
+
+// Features the client may offer in a hello.
+const (
+	FeatureBargeIn = "barge-in"
+	FeatureMarks   = "marks"
+	FeatureDTMF    = "dtmf"
+	FeatureAudio   = "audio"
+	FeatureAcks    = "acks"
+	// The events sent with Stream.SendEvent are features named after them.
+	FeatureNoInput        = "no-input"
+	FeatureSessionWarning = "session-warning"
+)
+
+// Hello offers what the client can do. The first codec is the one used when
+// the backend chooses none.
+type Hello struct {
+	Version   int          `json:"version"`
+	Codecs    []CodecOffer `json:"codecs"`
+	Framings  []Framing    `json:"framings"`
+	Languages []string     `json:"languages,omitempty"`
+	Features  []string     `json:"features"`
+}
+
+// CodecOffer is a codec with the sample rates it can run at.
+type CodecOffer struct {
+	Name        string `json:"name"`
+	SampleRates []int  `json:"sampleRates"`
+}
+
+// OfferCodecs lists codecs with their sample rates: G.711 only runs at 8kHz,
+// L16 at 16kHz or 8kHz.
+func OfferCodecs(codecs ...Codec) []CodecOffer {
+	offers := make([]CodecOffer, len(codecs))
+	for i, c := range codecs {
+		offers[i] = CodecOffer{Name: c.Name, SampleRates: sampleRates(c)}
+	}
+	return offers
+}
+
+func sampleRates(c Codec) []int {
+	if c.ID == L16.ID {
+		return []int{16000, 8000}
+	}
+	return []int{c.SampleRate}
+}
+
+// Welcome holds the choices of the backend. Empty fields leave the client's
+// defaults alone.
+type Welcome struct {
+	Version    int      `json:"version"`
+	Codec      string   `json:"codec,omitempty"`
+	SampleRate int      `json:"sampleRate,omitempty"`
+	Framing    Framing  `json:"framing,omitempty"`
+	Language   string   `json:"language,omitempty"`
+	Features   []string `json:"features"`
+}
+
+type helloMessage struct {
+	Event   string   `json:"event"`
+	Hello   *Hello   `json:"hello,omitempty"`
+	Welcome *Welcome `json:"welcome,omitempty"`
+}
+
+// Handshake sends hello through send and waits up to timeout for the
+// backend's welcome on ws, before anything else reads from it. A backend that
+// predates the handshake answers with something else or not at all; then
+// Handshake returns a nil Welcome and the message it read, if any, for the
+// caller to handle as usual.
+func Handshake(ws *websocket.Conn, send Sender, hello Hello, timeout time.Duration) (*Welcome, []byte, error) {
+	data, err := json.Marshal(&helloMessage{Event: EventHello, Hello: &hello})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := send(data, false); err != nil {
+		return nil, nil, err
+	}
+
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	defer ws.SetReadDeadline(time.Time{})
+	var reply []byte
+	if err := websocket.Message.Receive(ws, &reply); err != nil {
+		// 古いバックエンドは何も返さない
+		return nil, nil, nil
+	}
+	var m helloMessage
+	if json.Unmarshal(reply, &m) != nil || m.Event != EventWelcome || m.Welcome == nil {
+		return nil, reply, nil
+	}
+	if err := hello.check(*m.Welcome); err != nil {
+		return nil, nil, err
+	}
+	return m.Welcome, nil, nil
+}
+
+// check makes sure the backend only chose what was offered.
+func (h Hello) check(w Welcome) error {
+	if w.Version == 0 {
+		return fmt.Errorf("%w: no protocol version", ErrBadWelcome)
+	}
+	if w.Version < 1 || w.Version > h.Version {
+		return fmt.Errorf("%w: backend speaks protocol version %d, we speak up to %d", ErrBadWelcome, w.Version, h.Version)
+	}
+	var offer *CodecOffer
+	for i := range h.Codecs {
+		if h.Codecs[i].Name == w.Codec || w.Codec == "" && i == 0 {
+			offer = &h.Codecs[i]
+			break
+		}
+	}
+	if offer == nil {
+		return fmt.Errorf("%w: backend chose codec %q, which was not offered", ErrBadWelcome, w.Codec)
+	}
+	if w.SampleRate != 0 && !containsInt(offer.SampleRates, w.SampleRate) {
+		return fmt.Errorf("%w: backend chose %s at %dHz, which was not offered", ErrBadWelcome, offer.Name, w.SampleRate)
+	}
+	if w.Framing != "" && !containsString(framingStrings(h.Framings), string(w.Framing)) {
+		return fmt.Errorf("%w: backend chose framing %q, which was not offered", ErrBadWelcome, w.Framing)
+	}
+	for _, f := range w.Features {
+		if !containsString(h.Features, f) {
+			return fmt.Errorf("%w: backend chose feature %q, which was not offered", ErrBadWelcome, f)
+		}
+	}
+	return nil
+}
+
+// SelectedCodec returns the codec the backend chose, at its sample rate, or
+// fallback when it chose none.
+func (w Welcome) SelectedCodec(fallback Codec) (Codec, error) {
+	codec := fallback
+	if w.Codec != "" {
+		var err error
+		if codec, err = CodecByName(w.Codec); err != nil {
+			return Codec{}, fmt.Errorf("%w: %v", ErrBadWelcome, err)
+		}
+	}
+	if w.SampleRate != 0 && w.SampleRate != codec.SampleRate {
+		if !containsInt(sampleRates(codec), w.SampleRate) {
+			return Codec{}, fmt.Errorf("%w: %s does not run at %dHz", ErrBadWelcome, codec.Name, w.SampleRate)
+		}
+		codec.SampleRate = w.SampleRate
+	}
+	return codec, nil
+}
+
+// Has reports whether the backend accepted feature.
+func (w Welcome) Has(feature string) bool {
+	return containsString(w.Features, feature)
+}
+
+func framingStrings(framings []Framing) []string {
+	out := make([]string, len(framings))
+	for i, f := range framings {
+		out[i] = string(f)
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
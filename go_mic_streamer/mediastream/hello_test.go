@@ -0,0 +1,135 @@
+package mediastream
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var testHello = Hello{
+	Version:   ProtocolVersion,
+	Codecs:    OfferCodecs(Mulaw, L16),
+	Framings:  []Framing{FramingBinary, FramingJSON},
+	Languages: []string{"ja-JP"},
+	Features:  []string{FeatureMarks, FeatureDTMF},
+}
+
+// handshake runs Handshake against a backend that reads the hello and then
+// sends reply, unless it is empty.
+func handshake(t *testing.T, reply string) (*Welcome, []byte, error) {
+	hellos := make(chan Hello, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var m helloMessage
+		if err := websocket.JSON.Receive(ws, &m); err == nil && m.Hello != nil {
+			hellos <- *m.Hello
+		}
+		if reply != "" {
+			websocket.Message.Send(ws, reply)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	send := func(data []byte, binary bool) error { return websocket.Message.Send(ws, string(data)) }
+	w, rest, err := Handshake(ws, send, testHello, 100*time.Millisecond)
+
+	select {
+	case h := <-hellos:
+		if h.Version != ProtocolVersion || len(h.Codecs) != 2 || h.Languages[0] != "ja-JP" {
+			t.Errorf("backend got %+v", h)
+		}
+	case <-time.After(time.Second):
+		t.Error("backend got no hello")
+	}
+	return w, rest, err
+}
+
+func TestHandshake(t *testing.T) {
+	t.Run("Should return what the backend chose", func(t *testing.T) {
+		w, rest, err := handshake(t, `{"event":"welcome","welcome":{"version":1,"codec":"l16","sampleRate":8000,"framing":"media-json","features":["dtmf"]}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w == nil || rest != nil {
+			t.Fatalf("got %v, %q", w, rest)
+		}
+		codec, err := w.SelectedCodec(Mulaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec.Name != "l16" || codec.SampleRate != 8000 || w.Framing != FramingJSON {
+			t.Errorf("got %s at %dHz with %s", codec.Name, codec.SampleRate, w.Framing)
+		}
+		if !w.Has(FeatureDTMF) || w.Has(FeatureMarks) {
+			t.Errorf("got features %v", w.Features)
+		}
+	})
+
+	t.Run("Should refuse choices that were not offered", func(t *testing.T) {
+		replies := []string{
+			`{"event":"welcome","welcome":{}}`,
+			`{"event":"welcome","welcome":{"version":2}}`,
+			`{"event":"welcome","welcome":{"version":1,"codec":"alaw"}}`,
+			`{"event":"welcome","welcome":{"version":1,"sampleRate":24000}}`,
+			`{"event":"welcome","welcome":{"version":1,"sampleRate":16000}}`,
+			`{"event":"welcome","welcome":{"version":1,"codec":"mulaw","sampleRate":16000}}`,
+			`{"event":"welcome","welcome":{"version":1,"features":["video"]}}`,
+		}
+		for _, reply := range replies {
+			if _, _, err := handshake(t, reply); !errors.Is(err, ErrBadWelcome) {
+				t.Errorf("%s: got %v, want ErrBadWelcome", reply, err)
+			}
+		}
+	})
+
+	t.Run("Should hand back the first message of an older backend", func(t *testing.T) {
+		reply := `{"event":"reply","reply":{"text":"こんにちは"}}`
+		w, rest, err := handshake(t, reply)
+		if w != nil || err != nil || string(rest) != reply {
+			t.Errorf("got %v, %q, %v", w, rest, err)
+		}
+	})
+
+	t.Run("Should give up waiting on a backend that does not answer", func(t *testing.T) {
+		w, rest, err := handshake(t, "")
+		if w != nil || rest != nil || err != nil {
+			t.Errorf("got %v, %q, %v", w, rest, err)
+		}
+	})
+}
+
+func TestWelcomeCodec(t *testing.T) {
+	t.Run("Should keep the default when the backend chose none", func(t *testing.T) {
+		codec, err := Welcome{Version: 1}.SelectedCodec(Alaw)
+		if err != nil || codec.Name != "alaw" {
+			t.Errorf("got %s, %v", codec.Name, err)
+		}
+	})
+
+	t.Run("Should not run G.711 at another rate", func(t *testing.T) {
+		if _, err := (Welcome{Version: 1, Codec: "mulaw", SampleRate: 16000}).SelectedCodec(Mulaw); err == nil {
+			t.Error("got no error")
+		}
+	})
+
+	t.Run("Should encode as JSON with the offers", func(t *testing.T) {
+		b, _ := json.Marshal(&helloMessage{Event: EventHello, Hello: &testHello})
+		if !strings.Contains(string(b), `"framings":["media-binary.v1","media-json"]`) {
+			t.Errorf("got %s", b)
+		}
+		want := `"codecs":[{"name":"mulaw","sampleRates":[8000]},{"name":"l16","sampleRates":[16000,8000]}]`
+		if !strings.Contains(string(b), want) {
+			t.Errorf("got %s", b)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package mediastream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Events sent by the backend. Like Twilio's events, the body of each is
+// nested under the event name.
+const (
+	// EventReply carries text for the client to say.
+	EventReply = "reply"
+	// EventPartialReply carries the beginning of a reply that is still being
+	// generated. It is only shown, the full text follows in a "reply".
+	EventPartialReply = "partial_reply"
+	// EventTranscript echoes what the backend heard the user say.
+	EventTranscript = "transcript"
+	// EventAudio carries speech synthesized by the backend.
+	EventAudio   = "audio"
+	EventControl = "control"
+	EventError   = "error"
+)
+
+// Commands of a "control" message.
+const (
+	// ControlStop stops the reply being played; queued replies are kept.
+	ControlStop = "stop"
+	// ControlClear stops the reply being played and drops the queued ones,
+	// like a "clear" message.
+	ControlClear    = "clear"
+	ControlHangup   = "hangup"
+	ControlSetVoice = "set_voice"
+)
+
+type Reply struct {
+	Text string `json:"text"`
+}
+
+type Transcript struct {
+	Text  string `json:"text"`
+	Final bool   `json:"final"`
+}
+
+// Audio is a clip, or a chunk of a streamed clip, of speech. Chunks of one
+// clip share an ID and the last one has Last set; a message without an ID is
+// a whole clip. Playback of each chunk is reported with a mark named Mark, or
+// "ID:Chunk" if it is empty.
+type Audio struct {
+	// Encoding is "audio/wav" or the encoding of a codec, e.g. "audio/x-mulaw".
+	Encoding string `json:"encoding"`
+	// SampleRate of raw payloads; the codec's rate when zero.
+	SampleRate int    `json:"sampleRate,omitempty"`
+	Payload    string `json:"payload"`
+	ID         string `json:"id,omitempty"`
+	Chunk      int    `json:"chunk,omitempty"`
+	Last       bool   `json:"last,omitempty"`
+	Mark       string `json:"mark,omitempty"`
+}
+
+// Streamed reports whether more chunks of the clip follow.
+func (a Audio) Streamed() bool {
+	return a.ID != "" && !a.Last
+}
+
+// MarkName returns the name of the mark that reports the chunk as played,
+// or "" for a whole clip without a mark.
+func (a Audio) MarkName() string {
+	if a.Mark != "" || a.ID == "" {
+		return a.Mark
+	}
+	return a.ID + ":" + strconv.Itoa(a.Chunk)
+}
+
+// Decode returns the payload as mono samples and their sample rate.
+func (a Audio) Decode() ([]int16, int, error) {
+	b, err := base64.StdEncoding.DecodeString(a.Payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch a.Encoding {
+	case "audio/wav", "audio/x-wav", "audio/wave":
+		return ReadWAV(b)
+	}
+	codec, err := CodecByEncoding(a.Encoding)
+	if err != nil {
+		return nil, 0, err
+	}
+	rate := a.SampleRate
+	if rate == 0 {
+		rate = codec.SampleRate
+	}
+	return codec.Decode(b), rate, nil
+}
+
+type Control struct {
+	Command string `json:"command"`
+	// Speaker and Style select the voice for "set_voice" by VOICEVOX name.
+	Speaker string `json:"speaker,omitempty"`
+	Style   string `json:"style,omitempty"`
+	// Reason is logged for "hangup".
+	Reason string `json:"reason,omitempty"`
+}
+
+// BackendError is an error reported by the backend. A fatal error means the
+// backend cannot continue the session.
+type BackendError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Fatal   bool   `json:"fatal,omitempty"`
+}
+
+func (e *BackendError) Error() string {
+	if e.Code == "" {
+		return "backend: " + e.Message
+	}
+	return fmt.Sprintf("backend: %s: %s", e.Code, e.Message)
+}
+
+// Dispatcher decodes the messages the backend sends and calls the handler
+// for their event. Messages without a handler are ignored. Backends that
+// predate the typed messages send the reply as plain text, which is passed
+// to OnReply as is.
+type Dispatcher struct {
+	OnReply        func(Reply)
+	OnPartialReply func(Reply)
+	OnTranscript   func(Transcript)
+	OnAudio        func(Audio)
+	OnControl      func(Control)
+	OnError        func(BackendError)
+	OnMark         func(Mark)
+	OnClear        func()
+	OnAck          func(Ack)
+	OnNack         func(Ack)
+}
+
+// Dispatch handles one whole websocket message.
+func (d *Dispatcher) Dispatch(data []byte) error {
+	if !utf8.Valid(data) {
+		return fmt.Errorf("message is not valid UTF-8 (%d bytes)", len(data))
+	}
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil || m.Event == "" {
+		if d.OnReply != nil {
+			d.OnReply(Reply{Text: string(data)})
+		}
+		return nil
+	}
+
+	missing := func() error {
+		return fmt.Errorf("%s message without a %s body", m.Event, m.Event)
+	}
+	switch m.Event {
+	case EventReply:
+		if m.Reply == nil {
+			return missing()
+		}
+		if d.OnReply != nil {
+			d.OnReply(*m.Reply)
+		}
+	case EventPartialReply:
+		if m.PartialReply == nil {
+			return missing()
+		}
+		if d.OnPartialReply != nil {
+			d.OnPartialReply(*m.PartialReply)
+		}
+	case EventTranscript:
+		if m.Transcript == nil {
+			return missing()
+		}
+		if d.OnTranscript != nil {
+			d.OnTranscript(*m.Transcript)
+		}
+	case EventAudio:
+		if m.Audio == nil {
+			return missing()
+		}
+		if d.OnAudio != nil {
+			d.OnAudio(*m.Audio)
+		}
+	case EventControl:
+		if m.Control == nil {
+			return missing()
+		}
+		if d.OnControl != nil {
+			d.OnControl(*m.Control)
+		}
+	case EventError:
+		if m.Error == nil {
+			return missing()
+		}
+		if d.OnError != nil {
+			d.OnError(*m.Error)
+		}
+	case EventMark:
+		if m.Mark == nil {
+			return missing()
+		}
+		if d.OnMark != nil {
+			d.OnMark(*m.Mark)
+		}
+	case EventClear:
+		if d.OnClear != nil {
+			d.OnClear()
+		}
+	case EventAck:
+		if m.Ack == nil {
+			return missing()
+		}
+		if d.OnAck != nil {
+			d.OnAck(*m.Ack)
+		}
+	case EventNack:
+		if m.Nack == nil {
+			return missing()
+		}
+		if d.OnNack != nil {
+			d.OnNack(*m.Nack)
+		}
+	default:
+		return fmt.Errorf("unknown event %q", m.Event)
+	}
+	return nil
+}
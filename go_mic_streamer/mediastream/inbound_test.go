@@ -0,0 +1,127 @@
+package mediastream
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDispatcher(t *testing.T) {
+	t.Run("Should call the handler of each event", func(t *testing.T) {
+		var got []string
+		d := &Dispatcher{
+			OnReply:        func(r Reply) { got = append(got, "reply:"+r.Text) },
+			OnPartialReply: func(r Reply) { got = append(got, "partial:"+r.Text) },
+			OnTranscript: func(tr Transcript) {
+				if tr.Final {
+					got = append(got, "transcript:"+tr.Text)
+				}
+			},
+			OnAudio:   func(a Audio) { got = append(got, "audio:"+a.Encoding) },
+			OnControl: func(c Control) { got = append(got, "control:"+c.Command+":"+c.Speaker) },
+			OnError:   func(e BackendError) { got = append(got, e.Error()) },
+			OnMark:    func(m Mark) { got = append(got, "mark:"+m.Name) },
+			OnClear:   func() { got = append(got, "clear") },
+			OnAck:     func(a Ack) { got = append(got, "ack:"+a.ID) },
+			OnNack:    func(a Ack) { got = append(got, "nack:"+a.ID+":"+a.Reason) },
+		}
+		messages := []string{
+			`{"event":"partial_reply","partial_reply":{"text":"こんに"}}`,
+			`{"event":"reply","reply":{"text":"こんにちは"}}`,
+			`{"event":"transcript","transcript":{"text":"もしもし","final":true}}`,
+			`{"event":"audio","audio":{"encoding":"audio/wav","payload":""}}`,
+			`{"event":"control","control":{"command":"set_voice","speaker":"ずんだもん"}}`,
+			`{"event":"error","error":{"code":"llm_timeout","message":"no answer"}}`,
+			`{"event":"mark","mark":{"name":"m1"}}`,
+			`{"event":"clear","streamSid":"MZ1"}`,
+			`{"event":"ack","ack":{"id":"MZ1-1"}}`,
+			`{"event":"nack","nack":{"id":"MZ1-2","reason":"decode"}}`,
+		}
+		for _, m := range messages {
+			if err := d.Dispatch([]byte(m)); err != nil {
+				t.Errorf("%s: %v", m, err)
+			}
+		}
+		want := []string{
+			"partial:こんに",
+			"reply:こんにちは",
+			"transcript:もしもし",
+			"audio:audio/wav",
+			"control:set_voice:ずんだもん",
+			"backend: llm_timeout: no answer",
+			"mark:m1",
+			"clear",
+			"ack:MZ1-1",
+			"nack:MZ1-2:decode",
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Should pass plain text through as a reply", func(t *testing.T) {
+		long := strings.Repeat("長い返答です。", 100)
+		var got string
+		d := &Dispatcher{OnReply: func(r Reply) { got = r.Text }}
+		if err := d.Dispatch([]byte(long)); err != nil {
+			t.Fatal(err)
+		}
+		if got != long {
+			t.Errorf("got %d bytes, want %d", len(got), len(long))
+		}
+	})
+
+	t.Run("Should reject broken and unknown messages", func(t *testing.T) {
+		d := &Dispatcher{}
+		messages := []string{
+			"\xe3\x81",
+			`{"event":"reply"}`,
+			`{"event":"bogus"}`,
+		}
+		for _, m := range messages {
+			if err := d.Dispatch([]byte(m)); err == nil {
+				t.Errorf("%q: got no error", m)
+			}
+		}
+	})
+}
+
+func TestAudio(t *testing.T) {
+	samples := []int16{0, 1000, -1000, 32000, -32000}
+
+	t.Run("Should decode WAV and raw payloads", func(t *testing.T) {
+		cases := []struct {
+			audio Audio
+			rate  int
+		}{
+			{Audio{Encoding: "audio/wav", Payload: base64.StdEncoding.EncodeToString(EncodeWAV(samples, 16000, L16))}, 16000},
+			{Audio{Encoding: "audio/l16", SampleRate: 24000, Payload: base64.StdEncoding.EncodeToString(encodeL16(samples))}, 24000},
+			{Audio{Encoding: "audio/x-mulaw", Payload: base64.StdEncoding.EncodeToString(EncodeUlaw(samples))}, 8000},
+		}
+		for _, c := range cases {
+			got, rate, err := c.audio.Decode()
+			if err != nil {
+				t.Fatalf("%s: %v", c.audio.Encoding, err)
+			}
+			if rate != c.rate || len(got) != len(samples) {
+				t.Errorf("%s: got %d samples at %dHz", c.audio.Encoding, len(got), rate)
+			}
+		}
+		if _, _, err := (Audio{Encoding: "audio/ogg"}).Decode(); err == nil {
+			t.Error("got no error for audio/ogg")
+		}
+	})
+
+	t.Run("Should name marks after the chunk unless named", func(t *testing.T) {
+		cases := map[string]Audio{
+			"r1:2": {ID: "r1", Chunk: 2},
+			"m":    {ID: "r1", Chunk: 2, Mark: "m"},
+			"":     {},
+		}
+		for want, a := range cases {
+			if got := a.MarkName(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package mediastream
+
+// Message is one JSON message of the Twilio Media Streams protocol. Twilio
+// encodes sequence numbers, chunks and timestamps as strings.
+type Message struct {
+	Event          string `json:"event"`
+	SequenceNumber string `json:"sequenceNumber,omitempty"`
+	StreamSid      string `json:"streamSid,omitempty"`
+	// Protocol and Version are only set on "connected".
+	Protocol string `json:"protocol,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Start    *Start `json:"start,omitempty"`
+	Media    *Media `json:"media,omitempty"`
+	Stop     *Stop  `json:"stop,omitempty"`
+	Mark     *Mark  `json:"mark,omitempty"`
+	DTMF     *DTMF  `json:"dtmf,omitempty"`
+	// Segment follows the media of a recorded utterance, see Outbox.
+	Segment *Segment `json:"segment,omitempty"`
+	// The rest are sent by the backend, see Dispatcher.
+	Reply        *Reply        `json:"reply,omitempty"`
+	PartialReply *Reply        `json:"partial_reply,omitempty"`
+	Transcript   *Transcript   `json:"transcript,omitempty"`
+	Audio        *Audio        `json:"audio,omitempty"`
+	Control      *Control      `json:"control,omitempty"`
+	Error        *BackendError `json:"error,omitempty"`
+	Ack          *Ack          `json:"ack,omitempty"`
+	Nack         *Ack          `json:"nack,omitempty"`
+}
+
+type Start struct {
+	AccountSid       string            `json:"accountSid"`
+	StreamSid        string            `json:"streamSid"`
+	CallSid          string            `json:"callSid"`
+	Tracks           []string          `json:"tracks"`
+	CustomParameters map[string]string `json:"customParameters"`
+	MediaFormat      MediaFormat       `json:"mediaFormat"`
+}
+
+type MediaFormat struct {
+	Encoding   string `json:"encoding"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+}
+
+type Media struct {
+	Track     string `json:"track,omitempty"`
+	Chunk     string `json:"chunk,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Payload   string `json:"payload"`
+}
+
+type Stop struct {
+	AccountSid string `json:"accountSid"`
+	CallSid    string `json:"callSid"`
+}
+
+type Mark struct {
+	Name string `json:"name"`
+}
+
+type DTMF struct {
+	Track string `json:"track"`
+	Digit string `json:"digit"`
+}
+
+const (
+	EventConnected = "connected"
+	EventStart     = "start"
+	EventMedia     = "media"
+	EventStop      = "stop"
+	EventMark      = "mark"
+	EventDTMF      = "dtmf"
+	// EventClear is sent by the server to drop audio that has not been played yet.
+	EventClear = "clear"
+)
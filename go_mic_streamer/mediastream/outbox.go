@@ -0,0 +1,220 @@
+package mediastream
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// EventSegment is sent after the media of a recorded utterance.
+	EventSegment = "segment"
+	// EventAck and EventNack are sent by the backend for a segment it did or
+	// could not process.
+	EventAck  = "ack"
+	EventNack = "nack"
+)
+
+// Segment identifies a recorded utterance. A retransmitted segment keeps its
+// ID and sequence, so the backend can drop the copy if it already has it.
+type Segment struct {
+	ID       string `json:"id"`
+	Sequence int    `json:"sequence"`
+	// FirstChunk and LastChunk are the chunks of the media messages that
+	// carried it.
+	FirstChunk int  `json:"firstChunk"`
+	LastChunk  int  `json:"lastChunk"`
+	Retransmit bool `json:"retransmit,omitempty"`
+}
+
+// Ack is the body of "ack" and "nack" messages.
+type Ack struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Outbox sends recorded segments through a Stream and keeps each one until
+// the backend acks it. A nacked segment is sent again at once, and Retransmit
+// sends every unacked one again, e.g. after a reconnect. Segments still
+// waiting in the stream's backlog are not sent again, and only segments
+// actually written count as attempts. Segments are given up on after
+// MaxAttempts, and only the newest MaxPending are kept. Backends that never
+// ack get no retransmissions.
+type Outbox struct {
+	MaxAttempts int
+	MaxPending  int
+	stream      *Stream
+	pending     []*outboxSegment
+	sequence    int
+	// acking is set once the backend acked a segment.
+	acking bool
+	mu     sync.Mutex
+}
+
+type outboxSegment struct {
+	Segment
+	samples    []int16
+	sampleRate int
+	// attempts, queued and dropped are updated by the stream, which holds
+	// its own lock rather than o.mu.
+	attempts atomic.Int32
+	queued   atomic.Bool
+	// dropped is set when the stream dropped the segment from a backlog that
+	// grew too long.
+	dropped atomic.Bool
+}
+
+func NewOutbox(stream *Stream) *Outbox {
+	return &Outbox{
+		MaxAttempts: 3,
+		MaxPending:  10,
+		stream:      stream,
+	}
+}
+
+// Send numbers a segment and sends it.
+func (o *Outbox) Send(samples []int16, sampleRate int) (Segment, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sequence++
+	seg := &outboxSegment{
+		Segment:    Segment{ID: o.stream.StreamSid + "-" + strconv.Itoa(o.sequence), Sequence: o.sequence},
+		samples:    samples,
+		sampleRate: sampleRate,
+	}
+	if len(o.pending) >= o.MaxPending {
+		dropped := o.pending[0]
+		o.pending = o.pending[1:]
+		if o.acking {
+			log.Printf("Segment %s was never acked, giving up on it", dropped.ID)
+		}
+	}
+	o.pending = append(o.pending, seg)
+	return seg.Segment, o.sendLocked(seg, false)
+}
+
+func (o *Outbox) sendLocked(seg *outboxSegment, retransmit bool) error {
+	return o.stream.deliver(o.itemLocked(seg, retransmit))
+}
+
+func (o *Outbox) itemLocked(seg *outboxSegment, retransmit bool) backlogItem {
+	s := seg.Segment
+	s.Retransmit = retransmit
+	seg.queued.Store(true)
+	return o.stream.utterance(s, seg.samples, seg.sampleRate, func(written bool) {
+		if written {
+			seg.attempts.Add(1)
+		} else {
+			seg.dropped.Store(true)
+		}
+		seg.queued.Store(false)
+	})
+}
+
+// SetAcking tells the outbox whether the backend acks segments, e.g. as
+// agreed in the welcome, instead of waiting for the first ack.
+func (o *Outbox) SetAcking(acking bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.acking = acking
+}
+
+// Ack forgets the segment. It reports false for an ID that is not pending,
+// e.g. a second ack for a retransmitted segment.
+func (o *Outbox) Ack(id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.acking = true
+	i := o.indexLocked(id)
+	if i < 0 {
+		return false
+	}
+	o.pending = append(o.pending[:i], o.pending[i+1:]...)
+	return true
+}
+
+// Nack sends the segment again unless it has run out of attempts.
+func (o *Outbox) Nack(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.acking = true
+	i := o.indexLocked(id)
+	if i < 0 {
+		return fmt.Errorf("nack for unknown segment %s", id)
+	}
+	seg := o.pending[i]
+	if seg.queued.Load() {
+		// まだ送られていないので、届けば改めて ack か nack が来る
+		return nil
+	}
+	if attempts := int(seg.attempts.Load()); attempts >= o.MaxAttempts {
+		o.pending = append(o.pending[:i], o.pending[i+1:]...)
+		return fmt.Errorf("segment %s failed %d times, giving up", id, attempts)
+	}
+	return o.sendLocked(seg, true)
+}
+
+// Retransmit sends the unacked segments again, oldest first and ahead of
+// what the stream queued while disconnected, and returns how many were sent.
+func (o *Outbox) Retransmit() (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.acking {
+		return 0, nil
+	}
+	var kept, resend []*outboxSegment
+	for _, seg := range o.pending {
+		if seg.queued.Load() {
+			kept = append(kept, seg)
+			continue
+		}
+		if seg.dropped.Load() {
+			continue
+		}
+		if attempts := seg.attempts.Load(); int(attempts) >= o.MaxAttempts {
+			log.Printf("Segment %s was sent %d times, giving up on it", seg.ID, attempts)
+			continue
+		}
+		kept = append(kept, seg)
+		resend = append(resend, seg)
+	}
+	o.pending = kept
+	items := make([]backlogItem, len(resend))
+	for i, seg := range resend {
+		items[i] = o.itemLocked(seg, true)
+	}
+	return len(resend), o.stream.deliverAhead(items)
+}
+
+// Pending returns the number of unacked segments.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Outstanding returns the number of segments the backend will still get:
+// those waiting in the stream's backlog and, if the backend acks, the
+// unacked ones Retransmit sends again.
+func (o *Outbox) Outstanding() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, seg := range o.pending {
+		if seg.queued.Load() || o.acking && !seg.dropped.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+func (o *Outbox) indexLocked(id string) int {
+	for i, seg := range o.pending {
+		if seg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,220 @@
+package mediastream
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (r *recorded) segments() []*Segment {
+	var out []*Segment
+	for _, m := range r.messages {
+		if m.Event == EventSegment {
+			out = append(out, m.Segment)
+		}
+	}
+	return out
+}
+
+func TestOutbox(t *testing.T) {
+	samples := make([]int16, 320)
+
+	t.Run("Should follow the media of each segment with its ID and chunks", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		o := NewOutbox(s)
+		o.Send(samples, 8000)
+		o.Send(samples, 8000)
+
+		segs := r.segments()
+		if len(segs) != 2 {
+			t.Fatalf("got %d segment messages, want 2", len(segs))
+		}
+		if segs[0].ID == segs[1].ID || segs[0].Sequence != 1 || segs[1].Sequence != 2 {
+			t.Errorf("got %+v and %+v", segs[0], segs[1])
+		}
+		if segs[0].FirstChunk != 1 || segs[0].LastChunk != 2 || segs[1].FirstChunk != 3 || segs[1].LastChunk != 4 {
+			t.Errorf("got chunks %d-%d and %d-%d", segs[0].FirstChunk, segs[0].LastChunk, segs[1].FirstChunk, segs[1].LastChunk)
+		}
+		if o.Pending() != 2 {
+			t.Errorf("got %d pending, want 2", o.Pending())
+		}
+	})
+
+	t.Run("Should retransmit only unacked segments with the same ID", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		o := NewOutbox(s)
+		first, _ := o.Send(samples, 8000)
+		second, _ := o.Send(samples, 8000)
+
+		if !o.Ack(first.ID) {
+			t.Error("ack was not accepted")
+		}
+		if o.Ack(first.ID) {
+			t.Error("duplicate ack was accepted")
+		}
+		if n, err := o.Retransmit(); n != 1 || err != nil {
+			t.Fatalf("got %d, %v", n, err)
+		}
+
+		segs := r.segments()
+		last := segs[len(segs)-1]
+		if last.ID != second.ID || last.Sequence != second.Sequence || !last.Retransmit {
+			t.Errorf("got %+v", last)
+		}
+	})
+
+	t.Run("Should not retransmit to a backend that never acks", func(t *testing.T) {
+		s, _, _ := newTestStream()
+		o := NewOutbox(s)
+		o.Send(samples, 8000)
+
+		if n, _ := o.Retransmit(); n != 0 {
+			t.Errorf("got %d retransmitted, want 0", n)
+		}
+	})
+
+	t.Run("Should retransmit before the first ack when the backend said it acks", func(t *testing.T) {
+		s, _, _ := newTestStream()
+		o := NewOutbox(s)
+		o.SetAcking(true)
+		o.Send(samples, 8000)
+
+		if n, _ := o.Retransmit(); n != 1 {
+			t.Errorf("got %d retransmitted, want 1", n)
+		}
+	})
+
+	t.Run("Should retransmit after the new start and ahead of what was queued", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		o := NewOutbox(s)
+		o.SetAcking(true)
+		s.Start()
+		first, _ := o.Send(samples, 8000)
+		s.Detach()
+		second, _ := o.Send(samples, 8000)
+		s.SendMark("reply-1")
+
+		// 再接続: start を送り直し、送り直す区間を溜まった分より先に流す
+		s.Announce(r.send)
+		if n, err := o.Retransmit(); n != 1 || err != nil {
+			t.Fatalf("got %d, %v", n, err)
+		}
+		if err := s.Attach(r.send); err != nil {
+			t.Fatal(err)
+		}
+
+		reconnected := 0
+		for i, m := range r.messages {
+			if m.Event == EventConnected {
+				reconnected = i
+			}
+		}
+		var got []string
+		last := 0
+		for _, m := range r.messages[reconnected:] {
+			switch m.Event {
+			case EventStart:
+				got = append(got, "start")
+			case EventSegment:
+				got = append(got, m.Segment.ID)
+			case EventMark:
+				got = append(got, m.Mark.Name)
+			}
+			if n, _ := strconv.Atoi(m.SequenceNumber); m.SequenceNumber != "" && n <= last {
+				t.Errorf("sequence number %d after %d", n, last)
+			} else if n > 0 {
+				last = n
+			}
+		}
+		want := []string{"start", first.ID, second.ID, "reply-1"}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Should resend on nack until out of attempts", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		o := NewOutbox(s)
+		o.MaxAttempts = 2
+		seg, _ := o.Send(samples, 8000)
+
+		if err := o.Nack(seg.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Nack(seg.ID); err == nil {
+			t.Error("got no error after the last attempt")
+		}
+		if got := len(r.segments()); got != 2 {
+			t.Errorf("got %d sends, want 2", got)
+		}
+		if o.Pending() != 0 {
+			t.Errorf("got %d pending, want 0", o.Pending())
+		}
+	})
+
+	t.Run("Should not send again what is still waiting to be written", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		o := NewOutbox(s)
+		o.MaxAttempts = 1
+		first, _ := o.Send(samples, 8000)
+		o.Ack(first.ID)
+		s.Detach()
+		second, _ := o.Send(samples, 8000)
+
+		if n, _ := o.Retransmit(); n != 0 {
+			t.Errorf("got %d retransmitted, want 0", n)
+		}
+		if err := o.Nack(second.ID); err != nil {
+			t.Errorf("got %v for a nack of a queued segment", err)
+		}
+		if got := o.Outstanding(); got != 1 {
+			t.Errorf("got %d outstanding, want 1", got)
+		}
+		s.Attach(r.send)
+
+		if got := len(r.segments()); got != 2 {
+			t.Errorf("got %d sends, want 2", got)
+		}
+		// 実際に送られた 1 回だけが数えられる
+		if err := o.Nack(second.ID); err == nil {
+			t.Error("got no error after the only attempt")
+		}
+	})
+
+	t.Run("Should not send again what was dropped from the backlog", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		s.MaxBacklog = 30 * time.Millisecond
+		o := NewOutbox(s)
+		first, _ := o.Send(samples, 8000)
+		o.Ack(first.ID)
+		s.Detach()
+		o.Send(samples, 8000)
+		third, _ := o.Send(samples, 8000)
+
+		if n, _ := o.Retransmit(); n != 0 {
+			t.Errorf("got %d retransmitted, want 0", n)
+		}
+		s.Attach(r.send)
+
+		segs := r.segments()
+		if len(segs) != 2 || segs[1].ID != third.ID {
+			t.Errorf("got %d segments, want the first and the third", len(segs))
+		}
+		if got := o.Outstanding(); got != 1 {
+			t.Errorf("got %d outstanding, want only the third", got)
+		}
+	})
+
+	t.Run("Should keep only the newest segments", func(t *testing.T) {
+		s, _, _ := newTestStream()
+		o := NewOutbox(s)
+		o.MaxPending = 2
+		for i := 0; i < 3; i++ {
+			o.Send(samples, 8000)
+		}
+		if o.Pending() != 2 {
+			t.Errorf("got %d pending, want 2", o.Pending())
+		}
+	})
+}
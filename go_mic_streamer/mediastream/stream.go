@@ -0,0 +1,511 @@
+package mediastream
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotAccepted is returned for a message of a feature the backend did not
+// accept. Nothing is sent.
+var ErrNotAccepted = errors.New("not accepted by the backend")
+
+// Twilio streams 20ms frames.
+const frameTime = 20 * time.Millisecond
+
+// Sender writes one websocket message: a binary frame when binary is set,
+// otherwise a text frame.
+type Sender func(data []byte, binary bool) error
+
+// Stats counts the messages a stream handed to its Sender. MessageBytes is
+// their size before websocket framing; Conn.BytesWritten counts what actually
+// went on the wire. EncodeTime covers resampling, codec encoding and building
+// the messages, but not writing them.
+type Stats struct {
+	Messages     int
+	MessageBytes int64
+	AudioBytes   int64
+	EncodeTime   time.Duration
+}
+
+// Stream is the sending side of a Media Streams connection, playing the part
+// Twilio plays on a call: it announces the stream with "connected" and
+// "start", numbers every message, and sends audio as 20ms "media" frames
+// whose chunk numbers and timestamps follow the media clock. Codec is μ-law
+// at 8kHz like Twilio unless set otherwise before Start; with FramingBinary
+// the media frames are sent as binary frames instead of JSON.
+//
+// While the stream is detached from a connection, or after a write failed,
+// what is sent is kept in a backlog and written on Attach. Messages are
+// numbered and encoded only when they are written, so the numbering goes on
+// from the new "start" and the media use the codec and framing of the new
+// connection. Beyond MaxBacklog of audio, whole utterances are dropped,
+// oldest first; zero keeps everything.
+type Stream struct {
+	Codec            Codec
+	Framing          Framing
+	AccountSid       string
+	CallSid          string
+	StreamSid        string
+	Track            string
+	CustomParameters map[string]string
+	MaxBacklog       time.Duration
+	features         map[string]bool
+	announced        bool
+	send             Sender
+	backlog          []backlogItem
+	backlogAudio     time.Duration
+	dropped          int
+	droppedAudio     time.Duration
+	stats            Stats
+	sequence         int
+	chunk            int
+	started          time.Time
+	// clock is the timestamp of the next media frame.
+	clock time.Duration
+	now   func() time.Time
+	mu    sync.Mutex
+}
+
+// backlogItem is something sent while the stream could not write it. write
+// renders and writes it with the stream's state at that time; done, if set,
+// is told whether it was written or dropped.
+type backlogItem struct {
+	audio time.Duration
+	write func() error
+	done  func(written bool)
+}
+
+// NewStream returns a stream that writes through send, or a detached one
+// when send is nil.
+func NewStream(send Sender, customParameters map[string]string) *Stream {
+	s := &Stream{
+		Codec:            Mulaw,
+		Framing:          FramingJSON,
+		AccountSid:       newSid("AC"),
+		CallSid:          newSid("CA"),
+		StreamSid:        newSid("MZ"),
+		Track:            "inbound",
+		CustomParameters: customParameters,
+		send:             send,
+		now:              time.Now,
+	}
+	s.started = s.now()
+	return s
+}
+
+func newSid(prefix string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// Start sends "connected" and "start". The media clock restarts here.
+func (s *Stream) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = s.now()
+	s.announced = true
+	return s.deliverLocked(backlogItem{write: func() error { return s.announceLocked(s.send) }})
+}
+
+// Announce sends "connected" and "start" through send, e.g. to a new
+// connection before it is attached. Unlike Start it keeps the media clock
+// and the numbering going.
+func (s *Stream) Announce(send Sender) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.announceLocked(send)
+}
+
+func (s *Stream) announceLocked(send Sender) error {
+	s.announced = true
+	if err := s.sendJSON(send, &Message{Event: EventConnected, Protocol: "Call", Version: "1.0.0"}); err != nil {
+		return err
+	}
+	parameters := s.CustomParameters
+	if parameters == nil {
+		parameters = map[string]string{}
+	}
+	s.sequence++
+	return s.sendJSON(send, &Message{
+		Event:          EventStart,
+		SequenceNumber: strconv.Itoa(s.sequence),
+		StreamSid:      s.StreamSid,
+		Start: &Start{
+			AccountSid:       s.AccountSid,
+			StreamSid:        s.StreamSid,
+			CallSid:          s.CallSid,
+			Tracks:           []string{s.Track},
+			CustomParameters: parameters,
+			MediaFormat:      MediaFormat{Encoding: s.Codec.Encoding, SampleRate: s.Codec.SampleRate, Channels: 1},
+		},
+	})
+}
+
+// Attach makes the stream write through send, e.g. on a new connection,
+// starting with the backlog. If a write fails, the stream stays detached and
+// the error is returned.
+func (s *Stream) Attach(send Sender) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped > 0 {
+		log.Printf("Dropped %d utterances (%v of audio) while disconnected", s.dropped, s.droppedAudio)
+		s.dropped, s.droppedAudio = 0, 0
+	}
+	s.send = send
+	for len(s.backlog) > 0 {
+		item := s.backlog[0]
+		if err := item.write(); err != nil {
+			s.send = nil
+			return err
+		}
+		s.backlog = s.backlog[1:]
+		s.backlogAudio -= item.audio
+		item.finish(true)
+	}
+	return nil
+}
+
+// Detach keeps what is sent from now on in the backlog, e.g. when the
+// connection was lost.
+func (s *Stream) Detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send = nil
+}
+
+// deliverLocked writes item, or keeps it in the backlog while the stream is
+// detached. A failed write detaches the stream.
+func (s *Stream) deliverLocked(item backlogItem) error {
+	if s.send != nil && len(s.backlog) == 0 {
+		err := item.write()
+		if err == nil {
+			item.finish(true)
+			return nil
+		}
+		log.Println("Error writing to the backend, keeping the message until the next connection:", err)
+		s.send = nil
+	}
+	s.backlog = append(s.backlog, item)
+	s.backlogAudio += item.audio
+	s.trimBacklogLocked()
+	return nil
+}
+
+// trimBacklogLocked drops the oldest audio beyond MaxBacklog, but never the
+// newest item.
+func (s *Stream) trimBacklogLocked() {
+	for i := 0; s.MaxBacklog > 0 && s.backlogAudio > s.MaxBacklog && i < len(s.backlog)-1; {
+		item := s.backlog[i]
+		if item.audio == 0 {
+			i++
+			continue
+		}
+		s.backlog = append(s.backlog[:i], s.backlog[i+1:]...)
+		s.backlogAudio -= item.audio
+		s.dropped++
+		s.droppedAudio += item.audio
+		item.finish(false)
+	}
+}
+
+func (item backlogItem) finish(written bool) {
+	if item.done != nil {
+		item.done(written)
+	}
+}
+
+// SetFeatures limits what is sent besides the media to the features the
+// backend accepted. Until it is called, features is nil and everything is
+// sent.
+func (s *Stream) SetFeatures(features []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.features = map[string]bool{}
+	for _, f := range features {
+		s.features[f] = true
+	}
+}
+
+// Accepts reports whether the backend accepted feature.
+func (s *Stream) Accepts(feature string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acceptsLocked(feature)
+}
+
+func (s *Stream) acceptsLocked(feature string) bool {
+	return s.features == nil || s.features[feature]
+}
+
+// SetCodec changes the codec of the media sent from now on. Call it before
+// Announce so the start message has the new format.
+func (s *Stream) SetCodec(codec Codec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Codec = codec
+}
+
+// CurrentCodec returns the codec the media is sent with.
+func (s *Stream) CurrentCodec() Codec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Codec
+}
+
+// SetFraming changes the framing of the media sent from now on.
+func (s *Stream) SetFraming(framing Framing) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Framing = framing
+}
+
+// SendAudio sends mono samples as 20ms frames of Codec, padding the last one
+// with silence. Audio is sent in bursts after it was recorded, so the frames
+// are stamped as if they ended now, but never before the end of the
+// previous burst: timestamps stay monotonic and gaps show the silence in
+// between.
+func (s *Stream) SendAudio(samples []int16, sampleRate int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deliverLocked(backlogItem{
+		audio: audioDuration(samples, sampleRate),
+		write: func() error { return s.sendAudioLocked(samples, sampleRate) },
+	})
+}
+
+func audioDuration(samples []int16, sampleRate int) time.Duration {
+	return time.Duration(len(samples)) * time.Second / time.Duration(sampleRate)
+}
+
+func (s *Stream) sendAudioLocked(samples []int16, sampleRate int) error {
+	encodeStart := time.Now()
+	codec := s.Codec
+	payload := codec.Encode(Resample(samples, sampleRate, codec.SampleRate))
+	frameSize := codec.SampleRate * int(frameTime/time.Millisecond) / 1000 * codec.BytesPerSample
+	if rest := len(payload) % frameSize; rest != 0 {
+		for i := rest; i < frameSize; i++ {
+			payload = append(payload, codec.Silence)
+		}
+	}
+	s.stats.EncodeTime += time.Since(encodeStart)
+
+	frames := len(payload) / frameSize
+	start := s.now().Sub(s.started) - time.Duration(frames)*frameTime
+	if start > s.clock {
+		s.clock = start
+	}
+	for i := 0; i < frames; i++ {
+		s.chunk++
+		err := s.sendMediaLocked(FrameMedia, payload[i*frameSize:(i+1)*frameSize], s.clock)
+		if err != nil {
+			return err
+		}
+		s.clock += frameTime
+	}
+	return nil
+}
+
+// SendUtterance sends samples like SendAudio, followed by a "segment"
+// message that tells the backend which chunks make up seg.
+func (s *Stream) SendUtterance(seg Segment, samples []int16, sampleRate int) error {
+	return s.deliver(s.utterance(seg, samples, sampleRate, nil))
+}
+
+// deliver is deliverLocked for callers that build their own items.
+func (s *Stream) deliver(item backlogItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deliverLocked(item)
+}
+
+// deliverAhead writes items before the backlog, e.g. segments sent again
+// after a reconnect, which are older than anything queued meanwhile.
+func (s *Stream) deliverAhead(items []backlogItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.send != nil && len(s.backlog) == 0 {
+		for _, item := range items {
+			if err := s.deliverLocked(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, item := range items {
+		s.backlogAudio += item.audio
+	}
+	s.backlog = append(append([]backlogItem{}, items...), s.backlog...)
+	s.trimBacklogLocked()
+	return nil
+}
+
+// utterance is the item for SendUtterance. done is told whether it was
+// written or dropped from the backlog, with s.mu held.
+func (s *Stream) utterance(seg Segment, samples []int16, sampleRate int, done func(written bool)) backlogItem {
+	return backlogItem{
+		done:  done,
+		audio: audioDuration(samples, sampleRate),
+		write: func() error {
+			seg.FirstChunk = s.chunk + 1
+			if err := s.sendAudioLocked(samples, sampleRate); err != nil {
+				return err
+			}
+			seg.LastChunk = s.chunk
+			return s.sendLocked(&Message{Event: EventSegment, Segment: &seg})
+		},
+	}
+}
+
+// SendSegment sends a whole recorded segment as a WAV file of Codec in the
+// payload of one "media" message, for backends that transcribe files rather
+// than a live stream.
+func (s *Stream) SendSegment(samples []int16, sampleRate int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deliverLocked(backlogItem{
+		audio: audioDuration(samples, sampleRate),
+		write: func() error {
+			encodeStart := time.Now()
+			wavFile := EncodeWAV(samples, sampleRate, s.Codec)
+			s.stats.EncodeTime += time.Since(encodeStart)
+			s.chunk++
+			return s.sendMediaLocked(FrameSegment, wavFile, s.now().Sub(s.started))
+		},
+	})
+}
+
+func (s *Stream) sendMediaLocked(frameType byte, payload []byte, timestamp time.Duration) error {
+	s.sequence++
+	s.stats.AudioBytes += int64(len(payload))
+
+	encodeStart := time.Now()
+	var data []byte
+	var err error
+	binary := s.Framing == FramingBinary
+	if binary {
+		f := Frame{
+			Type:      frameType,
+			Codec:     s.Codec.ID,
+			Sequence:  uint32(s.sequence),
+			Chunk:     uint32(s.chunk),
+			Timestamp: uint32(timestamp.Milliseconds()),
+			Payload:   payload,
+		}
+		data, err = f.MarshalBinary()
+	} else {
+		data, err = json.Marshal(&Message{
+			Event:          EventMedia,
+			SequenceNumber: strconv.Itoa(s.sequence),
+			StreamSid:      s.StreamSid,
+			Media: &Media{
+				Track:     s.Track,
+				Chunk:     strconv.Itoa(s.chunk),
+				Timestamp: strconv.FormatInt(timestamp.Milliseconds(), 10),
+				Payload:   base64.StdEncoding.EncodeToString(payload),
+			},
+		})
+	}
+	s.stats.EncodeTime += time.Since(encodeStart)
+	if err != nil {
+		return err
+	}
+	return s.write(s.send, data, binary)
+}
+
+// SendMark tells the server that the audio it sent before the mark name has
+// been played (or cleared). It needs FeatureMarks.
+func (s *Stream) SendMark(name string) error {
+	if !s.Accepts(FeatureMarks) {
+		return fmt.Errorf("mark: %w", ErrNotAccepted)
+	}
+	return s.Send(&Message{Event: EventMark, Mark: &Mark{Name: name}})
+}
+
+// SendDTMF sends a key press. It needs FeatureDTMF.
+func (s *Stream) SendDTMF(digit string) error {
+	if !s.Accepts(FeatureDTMF) {
+		return fmt.Errorf("dtmf: %w", ErrNotAccepted)
+	}
+	return s.Send(&Message{Event: EventDTMF, DTMF: &DTMF{Track: "inbound_track", Digit: digit}})
+}
+
+// SendEvent sends an event that is not part of the Twilio protocol. Like
+// Twilio's own events, body is nested under the event name. It needs the
+// feature named like the event, e.g. "no-input" for "no_input".
+func (s *Stream) SendEvent(event string, body interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.acceptsLocked(strings.ReplaceAll(event, "_", "-")) {
+		return fmt.Errorf("%s: %w", event, ErrNotAccepted)
+	}
+	return s.deliverLocked(backlogItem{write: func() error {
+		s.sequence++
+		return s.sendJSON(s.send, map[string]interface{}{
+			"event":          event,
+			"sequenceNumber": strconv.Itoa(s.sequence),
+			"streamSid":      s.StreamSid,
+			event:            body,
+		})
+	}})
+}
+
+// Stop sends "stop" if the stream was announced; nothing should be sent
+// afterwards.
+func (s *Stream) Stop() error {
+	s.mu.Lock()
+	announced := s.announced
+	s.mu.Unlock()
+	if !announced {
+		return nil
+	}
+	return s.Send(&Message{Event: EventStop, Stop: &Stop{AccountSid: s.AccountSid, CallSid: s.CallSid}})
+}
+
+// Send numbers m and sends it.
+func (s *Stream) Send(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deliverLocked(backlogItem{write: func() error { return s.sendLocked(m) }})
+}
+
+func (s *Stream) sendLocked(m *Message) error {
+	s.sequence++
+	m.SequenceNumber = strconv.Itoa(s.sequence)
+	m.StreamSid = s.StreamSid
+	return s.sendJSON(s.send, m)
+}
+
+func (s *Stream) sendJSON(send Sender, v interface{}) error {
+	encodeStart := time.Now()
+	data, err := json.Marshal(v)
+	s.stats.EncodeTime += time.Since(encodeStart)
+	if err != nil {
+		return err
+	}
+	return s.write(send, data, false)
+}
+
+func (s *Stream) write(send Sender, data []byte, binary bool) error {
+	if err := send(data, binary); err != nil {
+		return err
+	}
+	s.stats.Messages++
+	s.stats.MessageBytes += int64(len(data))
+	return nil
+}
+
+func (s *Stream) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
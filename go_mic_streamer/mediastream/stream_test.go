@@ -0,0 +1,392 @@
+package mediastream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recorded struct {
+	messages []*Message
+	raw      [][]byte
+	frames   []*Frame
+}
+
+func (r *recorded) send(data []byte, binary bool) error {
+	if binary {
+		f := &Frame{}
+		if err := f.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		r.frames = append(r.frames, f)
+		return nil
+	}
+	m := &Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return err
+	}
+	r.messages = append(r.messages, m)
+	r.raw = append(r.raw, data)
+	return nil
+}
+
+func (r *recorded) media() []*Message {
+	var out []*Message
+	for _, m := range r.messages {
+		if m.Event == EventMedia {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestStream() (*Stream, *recorded, *fakeClock) {
+	r := &recorded{}
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewStream(r.send, map[string]string{"caller": "test"})
+	s.now = clock.now
+	return s, r, clock
+}
+
+func TestStream(t *testing.T) {
+	t.Run("Should announce the stream with connected and start", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		connected := r.messages[0]
+		if connected.Event != EventConnected || connected.SequenceNumber != "" || connected.Version != "1.0.0" {
+			t.Errorf("got %+v", connected)
+		}
+		start := r.messages[1]
+		if start.Event != EventStart || start.SequenceNumber != "1" || start.StreamSid != s.StreamSid {
+			t.Errorf("got %+v", start)
+		}
+		want := MediaFormat{Encoding: "audio/x-mulaw", SampleRate: 8000, Channels: 1}
+		if start.Start.MediaFormat != want || start.Start.CustomParameters["caller"] != "test" || start.Start.CallSid != s.CallSid {
+			t.Errorf("got %+v", start.Start)
+		}
+		if len(s.StreamSid) != 34 || s.StreamSid[:2] != "MZ" {
+			t.Errorf("got stream sid %q", s.StreamSid)
+		}
+	})
+
+	t.Run("Should send audio as numbered 20ms frames", func(t *testing.T) {
+		s, r, clock := newTestStream()
+		s.Start()
+		clock.t = clock.t.Add(time.Second)
+
+		// 16kHz で 50ms -> 8kHz で 400 サンプル -> 3 フレーム (最後は無音で埋める)
+		if err := s.SendAudio(make([]int16, 800), 16000); err != nil {
+			t.Fatal(err)
+		}
+
+		media := r.media()
+		if len(media) != 3 {
+			t.Fatalf("got %d frames, want 3", len(media))
+		}
+		for i, m := range media {
+			payload, _ := base64.StdEncoding.DecodeString(m.Media.Payload)
+			if len(payload) != 160 {
+				t.Errorf("frame %d: got %d bytes, want 160", i, len(payload))
+			}
+			if got, want := m.Media.Chunk, strconv.Itoa(i+1); got != want {
+				t.Errorf("frame %d: got chunk %s, want %s", i, got, want)
+			}
+			if got, want := m.SequenceNumber, strconv.Itoa(i+2); got != want {
+				t.Errorf("frame %d: got sequence %s, want %s", i, got, want)
+			}
+			if got, want := m.Media.Timestamp, strconv.Itoa(940+20*i); got != want {
+				t.Errorf("frame %d: got timestamp %s, want %s", i, got, want)
+			}
+		}
+	})
+
+	t.Run("Should frame and announce the selected codec", func(t *testing.T) {
+		for _, codec := range []Codec{Alaw, L16} {
+			s, r, _ := newTestStream()
+			s.Codec = codec
+			s.Start()
+
+			s.SendAudio(make([]int16, 320), 16000)
+
+			start := r.messages[1].Start
+			if start.MediaFormat.Encoding != codec.Encoding || start.MediaFormat.SampleRate != codec.SampleRate {
+				t.Errorf("%s: got %+v", codec.Name, start.MediaFormat)
+			}
+			payload, _ := base64.StdEncoding.DecodeString(r.media()[0].Media.Payload)
+			if want := codec.SampleRate / 50 * codec.BytesPerSample; len(payload) != want {
+				t.Errorf("%s: got %d bytes, want %d", codec.Name, len(payload), want)
+			}
+		}
+	})
+
+	t.Run("Should keep timestamps monotonic across bursts", func(t *testing.T) {
+		s, r, clock := newTestStream()
+		s.Start()
+		clock.t = clock.t.Add(100 * time.Millisecond)
+
+		s.SendAudio(make([]int16, 8000), 8000)
+		s.SendAudio(make([]int16, 160), 8000)
+
+		media := r.media()
+		last, _ := strconv.Atoi(media[len(media)-2].Media.Timestamp)
+		next, _ := strconv.Atoi(media[len(media)-1].Media.Timestamp)
+		if first := media[0].Media.Timestamp; first != "0" {
+			t.Errorf("got first timestamp %s, want 0", first)
+		}
+		if next != last+20 {
+			t.Errorf("got %d after %d, want %d", next, last, last+20)
+		}
+	})
+
+	t.Run("Should number marks, dtmf, custom events and stop", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		s.Start()
+		s.SendMark("reply-1")
+		s.SendDTMF("5")
+		s.SendEvent("no_input", map[string]int{"count": 1})
+		s.Stop()
+
+		mark := r.messages[2]
+		if mark.Mark.Name != "reply-1" || mark.SequenceNumber != "2" {
+			t.Errorf("got %+v", mark)
+		}
+		dtmf := r.messages[3]
+		if dtmf.DTMF.Digit != "5" || dtmf.DTMF.Track != "inbound_track" {
+			t.Errorf("got %+v", dtmf.DTMF)
+		}
+		var event map[string]interface{}
+		json.Unmarshal(r.raw[4], &event)
+		if event["event"] != "no_input" || event["sequenceNumber"] != "4" || event["streamSid"] != s.StreamSid {
+			t.Errorf("got %v", event)
+		}
+		stop := r.messages[5]
+		if stop.Event != EventStop || stop.Stop.CallSid != s.CallSid || stop.SequenceNumber != "5" {
+			t.Errorf("got %+v", stop)
+		}
+	})
+}
+
+func TestStreamFeatures(t *testing.T) {
+	t.Run("Should send only the events and key presses of accepted features", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		s.SetFeatures([]string{FeatureNoInput})
+
+		if err := s.SendEvent("no_input", map[string]int{"count": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SendEvent("session_warning", map[string]int{"remaining": 30}); !errors.Is(err, ErrNotAccepted) {
+			t.Errorf("got %v, want ErrNotAccepted", err)
+		}
+		if len(r.messages) != 1 || r.messages[0].Event != "no_input" {
+			t.Errorf("got %d messages", len(r.messages))
+		}
+		if err := s.SendDTMF("5"); !errors.Is(err, ErrNotAccepted) {
+			t.Errorf("got %v, want ErrNotAccepted", err)
+		}
+		if !s.Accepts(FeatureNoInput) || s.Accepts(FeatureSessionWarning) {
+			t.Error("got the wrong features")
+		}
+	})
+}
+
+func TestLegacyStream(t *testing.T) {
+	t.Run("Should send nothing but media to a backend without features", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		s.SetFeatures(nil)
+
+		s.SendSegment(make([]int16, 320), 16000)
+		if err := s.SendMark("reply-1"); !errors.Is(err, ErrNotAccepted) {
+			t.Errorf("got %v, want ErrNotAccepted", err)
+		}
+		s.SendDTMF("5")
+		s.SendEvent("no_input", map[string]int{"count": 1})
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.messages) != 1 || r.messages[0].Event != EventMedia {
+			t.Errorf("got %d messages, want only the media", len(r.messages))
+		}
+	})
+}
+
+func TestStreamBacklog(t *testing.T) {
+	t.Run("Should number what was sent while detached after the new start", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		s.Start()
+		s.Detach()
+		s.SendAudio(make([]int16, 160), 8000)
+		s.SendMark("reply-1")
+
+		if err := s.Announce(r.send); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Attach(r.send); err != nil {
+			t.Fatal(err)
+		}
+
+		var events, sequence []string
+		for _, m := range r.messages[2:] {
+			events = append(events, m.Event)
+			sequence = append(sequence, m.SequenceNumber)
+		}
+		if got, want := strings.Join(events, ","), "connected,start,media,mark"; got != want {
+			t.Errorf("got events %s, want %s", got, want)
+		}
+		if got, want := strings.Join(sequence, ","), ",2,3,4"; got != want {
+			t.Errorf("got sequence numbers %s, want %s", got, want)
+		}
+	})
+
+	t.Run("Should drop the oldest utterances beyond MaxBacklog but keep the marks", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		s.MaxBacklog = 100 * time.Millisecond
+		s.Detach()
+		for i := 0; i < 3; i++ {
+			// 60ms ずつ
+			s.SendUtterance(Segment{ID: strconv.Itoa(i)}, make([]int16, 480), 8000)
+			s.SendMark("mark-" + strconv.Itoa(i))
+		}
+		s.Attach(r.send)
+
+		var got []string
+		for _, m := range r.messages {
+			switch m.Event {
+			case EventSegment:
+				got = append(got, m.Segment.ID)
+			case EventMark:
+				got = append(got, m.Mark.Name)
+			}
+		}
+		if want := "mark-0,mark-1,2,mark-2"; strings.Join(got, ",") != want {
+			t.Errorf("got %v, want %s", got, want)
+		}
+		if media := r.media(); len(media) != 3 || media[0].Media.Chunk != "1" {
+			t.Errorf("got %d media messages, want 3 numbered from 1", len(media))
+		}
+	})
+
+	t.Run("Should keep a message that could not be written for the next attach", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		failing := func([]byte, bool) error { return errors.New("broken pipe") }
+		s.Attach(failing)
+
+		if err := s.SendMark("reply-1"); err != nil {
+			t.Errorf("got %v, want the mark kept", err)
+		}
+		s.SendMark("reply-2")
+		if err := s.Attach(r.send); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.messages) != 2 || r.messages[0].Mark.Name != "reply-1" || r.messages[1].Mark.Name != "reply-2" {
+			t.Errorf("got %d messages", len(r.messages))
+		}
+	})
+
+	t.Run("Should encode the backlog with the codec of the new connection", func(t *testing.T) {
+		s, r, _ := newTestStream()
+		s.Detach()
+		s.SendAudio(make([]int16, 320), 16000)
+		s.SetCodec(L16)
+		s.Attach(r.send)
+
+		media := r.media()
+		if len(media) != 1 {
+			t.Fatalf("got %d media messages, want 1", len(media))
+		}
+		if payload, _ := base64.StdEncoding.DecodeString(media[0].Media.Payload); len(payload) != 640 {
+			t.Errorf("got %d bytes, want 20ms of 16kHz linear PCM", len(payload))
+		}
+	})
+}
+
+func TestBinaryFraming(t *testing.T) {
+	t.Run("Should send media as binary frames and control messages as JSON", func(t *testing.T) {
+		s, r, clock := newTestStream()
+		s.Framing = FramingBinary
+		s.Start()
+		clock.t = clock.t.Add(time.Second)
+
+		s.SendAudio(make([]int16, 320), 8000)
+		s.SendMark("m")
+
+		if len(r.frames) != 2 {
+			t.Fatalf("got %d binary frames, want 2", len(r.frames))
+		}
+		f := r.frames[1]
+		if f.Type != FrameMedia || f.Codec != Mulaw.ID || f.Sequence != 3 || f.Chunk != 2 || f.Timestamp != 980 || len(f.Payload) != 160 {
+			t.Errorf("got %+v", f)
+		}
+		if m := r.messages[len(r.messages)-1]; m.Event != EventMark || m.SequenceNumber != "4" {
+			t.Errorf("got %+v", m)
+		}
+	})
+
+	t.Run("Should put fewer bytes on the wire than JSON", func(t *testing.T) {
+		samples := make([]int16, 16000)
+		sizes := map[Framing]int64{}
+		for _, framing := range []Framing{FramingJSON, FramingBinary} {
+			s, _, _ := newTestStream()
+			s.Framing = framing
+			s.SendAudio(samples, 16000)
+			stats := s.Stats()
+			if stats.Messages != 50 || stats.AudioBytes != 8000 {
+				t.Errorf("%s: got %+v", framing, stats)
+			}
+			sizes[framing] = stats.MessageBytes
+		}
+		// 50 フレーム x (160 + 16) バイト
+		if got := sizes[FramingBinary]; got != 50*176 {
+			t.Errorf("got %d binary bytes, want %d", got, 50*176)
+		}
+		if sizes[FramingJSON] < sizes[FramingBinary]*3/2 {
+			t.Errorf("JSON %d bytes vs binary %d bytes", sizes[FramingJSON], sizes[FramingBinary])
+		}
+	})
+
+	t.Run("Should fall back to JSON unless the server picked binary", func(t *testing.T) {
+		cases := map[Framing][]string{
+			FramingBinary: {"media-binary.v1"},
+			FramingJSON:   {"media-binary.v1", "media-json"},
+		}
+		for want, selected := range cases {
+			if got := NegotiateFraming(selected); got != want {
+				t.Errorf("%v: got %s, want %s", selected, got, want)
+			}
+		}
+		if got := NegotiateFraming(nil); got != FramingJSON {
+			t.Errorf("got %s, want %s", got, FramingJSON)
+		}
+	})
+}
+
+func benchmarkSendAudio(b *testing.B, framing Framing) {
+	samples := make([]int16, 16000)
+	for i := range samples {
+		samples[i] = int16(i * 7)
+	}
+	s := NewStream(func([]byte, bool) error { return nil }, nil)
+	s.Framing = framing
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.SendAudio(samples, 16000)
+	}
+	b.ReportMetric(float64(s.Stats().MessageBytes)/float64(b.N), "message-bytes/op")
+}
+
+func BenchmarkSendAudioJSON(b *testing.B)   { benchmarkSendAudio(b, FramingJSON) }
+func BenchmarkSendAudioBinary(b *testing.B) { benchmarkSendAudio(b, FramingBinary) }
@@ -0,0 +1,218 @@
+package player
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStalled is returned by PlayStream when no chunk arrived for MaxWait.
+var ErrStalled = errors.New("audio stream stalled")
+
+// AudioStream is speech synthesized elsewhere, e.g. by the backend, that
+// arrives in chunks. PlayStream plays it through the same path as local
+// speech, at the speech rate but without mastering. Playback starts once
+// Prebuffer of audio is queued (or the stream is complete) and waits for the
+// same amount again after running dry, so network jitter does not chop up
+// the speech.
+type AudioStream struct {
+	Prebuffer time.Duration
+	// MaxWait is how long playback waits for the next chunk before it gives
+	// up with ErrStalled.
+	MaxWait  time.Duration
+	chunks   []audioChunk
+	queued   time.Duration
+	lastPush time.Time
+	closed   bool
+	// discarded is set once the stream was stopped or cleared.
+	discarded bool
+	mu        sync.Mutex
+}
+
+type audioChunk struct {
+	clip   *clip
+	played func()
+}
+
+func NewAudioStream(prebuffer time.Duration) *AudioStream {
+	return &AudioStream{
+		Prebuffer: prebuffer,
+		MaxWait:   5 * time.Second,
+		lastPush:  time.Now(),
+	}
+}
+
+// Push queues mono samples. played, if not nil, is called once they have been
+// heard, i.e. played and drained from the sink, or right away when the stream
+// was discarded.
+func (s *AudioStream) Push(samples []int16, sampleRate int, played func()) {
+	if played == nil {
+		played = func() {}
+	}
+	c := &clip{sampleRate: sampleRate, channels: 1, pcm: samplesToPCM(samples)}
+	s.mu.Lock()
+	if s.discarded {
+		s.mu.Unlock()
+		played()
+		return
+	}
+	s.chunks = append(s.chunks, audioChunk{clip: c, played: played})
+	s.queued += c.duration()
+	s.lastPush = time.Now()
+	s.mu.Unlock()
+}
+
+// Close tells playback that no more chunks will follow.
+func (s *AudioStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// Discard drops the queued chunks and any pushed later, calling their played
+// callbacks as if they had been played.
+func (s *AudioStream) Discard() {
+	s.mu.Lock()
+	chunks := s.chunks
+	s.chunks, s.queued, s.discarded = nil, 0, true
+	s.mu.Unlock()
+	for _, c := range chunks {
+		c.played()
+	}
+}
+
+// next waits for the next chunk, calling idle while it waits. With rebuffer
+// it first waits until Prebuffer is queued. It reports false when the stream
+// is complete.
+func (s *AudioStream) next(rebuffer bool, stopped func() bool, idle func()) (audioChunk, bool, error) {
+	const tick = 10 * time.Millisecond
+	for {
+		s.mu.Lock()
+		stalled := time.Since(s.lastPush) > s.MaxWait
+		if len(s.chunks) > 0 && (!rebuffer || s.closed || stalled || s.queued >= s.Prebuffer) {
+			c := s.chunks[0]
+			s.chunks = s.chunks[1:]
+			s.queued -= c.clip.duration()
+			s.mu.Unlock()
+			return c, true, nil
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return audioChunk{}, false, nil
+		}
+		if stopped() {
+			return audioChunk{}, false, ErrStopped
+		}
+		if stalled {
+			return audioChunk{}, false, ErrStalled
+		}
+		idle()
+		time.Sleep(tick)
+	}
+}
+
+// empty reports whether no chunk is queued right now.
+func (s *AudioStream) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.chunks) == 0
+}
+
+// PlayStream plays s as one utterance until it is complete and has been
+// heard. Stop interrupts it like Say; the chunks that were not played are
+// discarded.
+func (p *Player) PlayStream(s *AudioStream) error {
+	stopped := p.stoppedSince(p.stopGen.Load())
+	defer s.Discard()
+
+	// 再生済みのチャンクは、シンクから聞こえ終わる頃に played を呼ぶ
+	var unheard []heardCallback
+	callHeard := func() {
+		for len(unheard) > 0 && !time.Now().Before(unheard[0].at) {
+			unheard[0].played()
+			unheard = unheard[1:]
+		}
+	}
+	defer func() {
+		for _, h := range unheard {
+			h.played()
+		}
+	}()
+
+	marker, _ := p.Sink.(UtteranceMarker)
+	begun := false
+	end := func(err error) error {
+		if !begun || marker == nil {
+			return err
+		}
+		if endErr := marker.EndUtterance(); err == nil {
+			return endErr
+		}
+		return err
+	}
+
+	// チャンクは短いので、ストレッチャーはチャンクをまたいで使い、最後にだけ吐き出す
+	var ts *TimeStretcher
+	var format AudioFormat
+	defer func() {
+		if ts != nil {
+			ts.Flush()
+		}
+	}()
+
+	rebuffer := true
+	for {
+		c, ok, err := s.next(rebuffer, stopped, callHeard)
+		if err != nil {
+			return end(err)
+		}
+		if !ok {
+			if ts != nil {
+				err = p.flush(ts, format)
+			}
+			if endErr := end(nil); err == nil {
+				err = endErr
+			}
+			p.Drain()
+			return err
+		}
+		if !begun && marker != nil {
+			marker.BeginUtterance()
+		}
+		begun = true
+		if ts != nil && c.clip.format() != format {
+			if err := p.flush(ts, format); err != nil {
+				return end(err)
+			}
+		}
+		format = c.clip.format()
+		ts = p.stretcherFor(format)
+		err = p.process(ts, format, pcmToSamples(c.clip.pcm), stopped)
+		unheard = append(unheard, heardCallback{time.Now().Add(p.buffered()), c.played})
+		if err != nil {
+			return end(err)
+		}
+		callHeard()
+		// 再生が追いついてしまったら、またバッファが溜まるまで待つ
+		rebuffer = s.empty()
+	}
+}
+
+type heardCallback struct {
+	at     time.Time
+	played func()
+}
+
+// buffered is how long the sink keeps playing what it was given.
+func (p *Player) buffered() time.Duration {
+	if b, ok := p.Sink.(Buffering); ok {
+		return b.Buffered()
+	}
+	return 0
+}
+
+// Drain waits until the audio handed to the sink has been heard.
+func (p *Player) Drain() {
+	time.Sleep(p.buffered())
+}
@@ -0,0 +1,152 @@
+package player
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlayStream(t *testing.T) {
+	// 100ms at 8kHz
+	chunk := make([]int16, 800)
+
+	t.Run("Should wait for the prebuffer and report every chunk once played", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &countingSink{}
+		p.Sink = sink
+		s := NewAudioStream(250 * time.Millisecond)
+
+		var mu sync.Mutex
+		var played []int
+		var sinkBytesAtFirst int
+		go func() {
+			for i := 0; i < 4; i++ {
+				i := i
+				s.Push(chunk, 8000, func() {
+					mu.Lock()
+					defer mu.Unlock()
+					played = append(played, i)
+				})
+				if i == 1 {
+					time.Sleep(30 * time.Millisecond)
+					sinkBytesAtFirst = sink.played()
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			s.Close()
+		}()
+
+		if err := p.PlayStream(s); err != nil {
+			t.Fatal(err)
+		}
+		if sinkBytesAtFirst != 0 {
+			t.Errorf("playback started with 200ms queued, %d bytes played", sinkBytesAtFirst)
+		}
+		if got, want := sink.played(), 4*len(chunk)*2; got != want {
+			t.Errorf("got %d bytes, want %d", got, want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(played) != 4 || played[0] != 0 || played[3] != 3 {
+			t.Errorf("got chunks %v played", played)
+		}
+	})
+
+	t.Run("Should discard the rest when stopped", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		p.Sink = &stoppingSink{player: p}
+		s := NewAudioStream(0)
+		var played int
+		for i := 0; i < 3; i++ {
+			s.Push(chunk, 8000, func() { played++ })
+		}
+
+		if err := p.PlayStream(s); err != ErrStopped {
+			t.Errorf("got %v, want ErrStopped", err)
+		}
+		s.Push(chunk, 8000, func() { played++ })
+		if played != 4 {
+			t.Errorf("got %d chunks reported, want 4", played)
+		}
+	})
+
+	t.Run("Should give up when no chunk arrives", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		p.Sink = &countingSink{}
+		s := NewAudioStream(time.Second)
+		s.MaxWait = 50 * time.Millisecond
+		s.Push(chunk, 8000, nil)
+
+		if err := p.PlayStream(s); err != ErrStalled {
+			t.Errorf("got %v, want ErrStalled", err)
+		}
+	})
+
+	t.Run("Should play 20ms chunks at the speech rate", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &countingSink{}
+		p.Sink = sink
+		p.SetSpeechRate(1.5)
+		s := NewAudioStream(0)
+		// 1 秒分を 20ms ずつ
+		speech := sine(440, 0.3, 16000, time.Second)
+		for i := 0; i < len(speech); i += 320 {
+			s.Push(speech[i:i+320], 16000, nil)
+		}
+		s.Close()
+
+		if err := p.PlayStream(s); err != nil {
+			t.Fatal(err)
+		}
+		want := 2 * 16000 / 1.5
+		if got := float64(sink.played()); got < want*0.9 || got > want*1.1 {
+			t.Errorf("got %.0f bytes, want about %.0f", got, want)
+		}
+	})
+
+	t.Run("Should report a chunk only once the sink has played it out", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &realTimeSink{}
+		p.Sink = sink
+		s := NewAudioStream(0)
+		var heardAt time.Time
+		s.Push(chunk, 8000, func() { heardAt = time.Now() })
+		s.Close()
+
+		start := time.Now()
+		if err := p.PlayStream(s); err != nil {
+			t.Fatal(err)
+		}
+
+		if heardAt.IsZero() {
+			t.Fatal("chunk was not reported")
+		}
+		if got := heardAt.Sub(start); got < 90*time.Millisecond {
+			t.Errorf("reported after %v, before the 100ms chunk was heard", got)
+		}
+		if got := sink.Buffered(); got > 0 {
+			t.Errorf("PlayStream returned with %v still buffered", got)
+		}
+	})
+}
+
+// realTimeSink takes audio at once and plays it out in real time.
+type realTimeSink struct {
+	playout playout
+	mu      sync.Mutex
+}
+
+func (s *realTimeSink) Play(format AudioFormat, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.playout.add(format, len(b))
+	return nil
+}
+
+func (s *realTimeSink) Buffered() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.playout.buffered()
+}
+
+func (s *realTimeSink) Close() error { return nil }
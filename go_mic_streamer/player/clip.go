@@ -0,0 +1,117 @@
+package player
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/youpy/go-wav"
+)
+
+// clip is a block of 16-bit little endian PCM ready to be played.
+type clip struct {
+	sampleRate int
+	channels   int
+	pcm        []byte
+	timing     []TimingEvent
+	// raw are the frames, in order, that mastering and the time stretcher
+	// leave alone, such as markup tones.
+	raw []frameRange
+}
+
+// frameRange is the frames from start up to, not including, end.
+type frameRange struct {
+	start int
+	end   int
+}
+
+func (c *clip) format() AudioFormat {
+	return AudioFormat{c.sampleRate, c.channels}
+}
+
+func (c *clip) frames() int {
+	return len(c.pcm) / (2 * c.channels)
+}
+
+func (c *clip) duration() time.Duration {
+	return c.frameTime(c.frames())
+}
+
+func (c *clip) frameTime(frame int) time.Duration {
+	return time.Duration(frame) * time.Second / time.Duration(c.sampleRate)
+}
+
+// playbackTime is how long it takes to play c up to t at rate, given that
+// the raw frames are not stretched.
+func (c *clip) playbackTime(t time.Duration, rate float64) time.Duration {
+	var raw time.Duration
+	for _, r := range c.raw {
+		start, end := c.frameTime(r.start), c.frameTime(r.end)
+		if start >= t {
+			break
+		}
+		if end > t {
+			end = t
+		}
+		raw += end - start
+	}
+	return time.Duration(float64(t-raw)/rate) + raw
+}
+
+func decodeWAV(b []byte) (*clip, error) {
+	r := wav.NewReader(bytes.NewReader(b))
+	format, err := r.Format()
+	if err != nil {
+		return nil, err
+	}
+	if format.AudioFormat != wav.AudioFormatPCM || format.BitsPerSample != 16 {
+		return nil, fmt.Errorf("unsupported wav format %d/%d bit", format.AudioFormat, format.BitsPerSample)
+	}
+	pcm, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &clip{sampleRate: int(format.SampleRate), channels: int(format.NumChannels), pcm: pcm}, nil
+}
+
+// concat appends other to c. A nil c is treated as empty.
+func (c *clip) concat(other *clip) (*clip, error) {
+	if c == nil {
+		return other, nil
+	}
+	if other == nil {
+		return c, nil
+	}
+	if c.sampleRate != other.sampleRate || c.channels != other.channels {
+		return nil, fmt.Errorf("cannot join %dHz/%dch audio with %dHz/%dch", other.sampleRate, other.channels, c.sampleRate, c.channels)
+	}
+	pcm := make([]byte, 0, len(c.pcm)+len(other.pcm))
+	pcm = append(pcm, c.pcm...)
+	pcm = append(pcm, other.pcm...)
+	timing := append([]TimingEvent{}, c.timing...)
+	offset := c.duration()
+	for _, ev := range other.timing {
+		ev.Start += offset
+		ev.End += offset
+		timing = append(timing, ev)
+	}
+	raw := append([]frameRange{}, c.raw...)
+	for _, r := range other.raw {
+		raw = append(raw, frameRange{r.start + c.frames(), r.end + c.frames()})
+	}
+	return &clip{c.sampleRate, c.channels, pcm, timing, raw}, nil
+}
+
+// silence returns d of silence in the format of like, or VOICEVOX's default
+// 24kHz mono when like is nil.
+func silence(d time.Duration, like *clip) *clip {
+	c := &clip{sampleRate: 24000, channels: 1}
+	if like != nil {
+		c.sampleRate = like.sampleRate
+		c.channels = like.channels
+	}
+	frames := int(d.Seconds() * float64(c.sampleRate))
+	c.pcm = make([]byte, frames*c.channels*2)
+	return c
+}
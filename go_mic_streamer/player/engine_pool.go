@@ -0,0 +1,113 @@
+package player
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoHealthyEngine is returned when every engine failed its health check.
+var ErrNoHealthyEngine = errors.New("voicevox: no healthy engine")
+
+type engine struct {
+	endpoint    string
+	breaker     *circuitBreaker
+	outstanding int
+	healthy     bool
+	mu          sync.Mutex
+}
+
+func (e *engine) isHealthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.healthy
+}
+
+func (e *engine) setHealthy(healthy bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.healthy = healthy
+}
+
+// enginePool picks the healthy engine with the least outstanding requests.
+type enginePool struct {
+	engines []*engine
+	next    int
+	mu      sync.Mutex
+}
+
+func newEnginePool(endpoints []string) *enginePool {
+	pool := &enginePool{}
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		if endpoint == "" {
+			continue
+		}
+		pool.engines = append(pool.engines, &engine{
+			endpoint: endpoint,
+			breaker:  newCircuitBreaker(5, 10*time.Second),
+			healthy:  true,
+		})
+	}
+	return pool
+}
+
+func (pool *enginePool) endpoints() []string {
+	var endpoints []string
+	for _, e := range pool.engines {
+		endpoints = append(endpoints, e.endpoint)
+	}
+	return endpoints
+}
+
+// acquire returns the selected engine with its outstanding count incremented.
+// It fails with ErrNoHealthyEngine when no engine is healthy, and with
+// ErrCircuitOpen when the healthy ones do not accept requests.
+func (pool *enginePool) acquire() (*engine, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var best *engine
+	n := len(pool.engines)
+	// 同数のときに先頭へ偏らないよう、開始位置をずらしながら走査する
+	for i := 0; i < n; i++ {
+		e := pool.engines[(pool.next+i)%n]
+		if !e.isHealthy() {
+			continue
+		}
+		if best == nil || e.outstanding < best.outstanding {
+			best = e
+		}
+	}
+	if best == nil {
+		return nil, ErrNoHealthyEngine
+	}
+	if !best.breaker.allow() {
+		if best = pool.fallbackEngine(best); best == nil {
+			return nil, ErrCircuitOpen
+		}
+	}
+	pool.next = (pool.next + 1) % n
+	best.outstanding++
+	return best, nil
+}
+
+// fallbackEngine looks for any other healthy engine whose breaker lets a request through.
+func (pool *enginePool) fallbackEngine(skip *engine) *engine {
+	for _, e := range pool.engines {
+		if e == skip || !e.isHealthy() {
+			continue
+		}
+		if e.breaker.allow() {
+			return e
+		}
+	}
+	return nil
+}
+
+func (pool *enginePool) release(e *engine) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	e.outstanding--
+}
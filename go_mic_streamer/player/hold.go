@@ -0,0 +1,204 @@
+package player
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HoldAudio fills the silence while the backend is working on a reply. Once
+// Delay has passed after Start, it says Text (if set) and then plays a soft
+// hold tone until Stop. Stop fades out whatever is playing, cancels the
+// synthesis of Text if it is still running, and returns once the sink is
+// free for the real reply.
+type HoldAudio struct {
+	Text  string
+	Delay time.Duration
+	// ToneInterval is the time between the starts of two hold tones.
+	ToneInterval time.Duration
+	// OnPlay is called before the hold audio starts to sound, e.g. to keep
+	// the microphone from recording it, and OnStop once it has stopped.
+	OnPlay func()
+	OnStop func()
+	player *Player
+	filler *clip
+	// fillerVoice is the voice filler was synthesized with.
+	fillerVoice config
+	stopped     *atomic.Bool
+	cancel      context.CancelFunc
+	done        chan struct{}
+	mu          sync.Mutex
+}
+
+func NewHoldAudio(player *Player, text string, delay time.Duration) *HoldAudio {
+	return &HoldAudio{
+		Text:         text,
+		Delay:        delay,
+		ToneInterval: 2 * time.Second,
+		player:       player,
+	}
+}
+
+// Start arms the hold audio. Calling Start while it is armed or playing does nothing.
+func (h *HoldAudio) Start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(context.Background())
+	h.stopped = &atomic.Bool{}
+	h.done = make(chan struct{})
+	go h.run(ctx, h.stopped, h.done)
+}
+
+func (h *HoldAudio) Stop() {
+	h.mu.Lock()
+	stopped, cancel, done := h.stopped, h.cancel, h.done
+	h.stopped, h.cancel, h.done = nil, nil, nil
+	h.mu.Unlock()
+	if done == nil {
+		return
+	}
+	stopped.Store(true)
+	cancel()
+	<-done
+}
+
+func (h *HoldAudio) run(ctx context.Context, stopped *atomic.Bool, done chan struct{}) {
+	defer close(done)
+	if !sleepUnless(h.Delay, stopped) {
+		return
+	}
+
+	p := h.player
+	gen := p.stopGen.Load()
+	isStopped := func() bool { return stopped.Load() || p.stopGen.Load() != gen }
+
+	var filler *clip
+	if h.Text != "" {
+		filler = h.fillerClip(ctx)
+	}
+	if isStopped() {
+		return
+	}
+	if h.OnPlay != nil {
+		h.OnPlay()
+	}
+	if h.OnStop != nil {
+		defer h.OnStop()
+	}
+	if filler != nil {
+		if err := p.output(filler, isStopped); err != nil {
+			if err != ErrStopped {
+				log.Println("Could not play filler:", err)
+			}
+			return
+		}
+	}
+
+	tone := holdTone(AudioFormat{SampleRate: 24000, Channels: 1})
+	for !isStopped() {
+		start := time.Now()
+		if err := p.output(tone, isStopped); err != nil {
+			if err != ErrStopped {
+				log.Println("Could not play hold tone:", err)
+			}
+			return
+		}
+		if !sleepUnless(h.ToneInterval-time.Since(start), stopped) {
+			return
+		}
+	}
+}
+
+// fillerClip synthesizes Text once per voice and keeps it for later turns.
+// It returns nil when synthesis fails or ctx is cancelled, in which case only
+// the hold tone is played.
+func (h *HoldAudio) fillerClip(ctx context.Context) *clip {
+	voice := h.player.voice()
+	if h.filler != nil && h.fillerVoice == voice {
+		return h.filler
+	}
+	c, err := h.player.synthesize(ctx, h.Text)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Println("Could not synthesize filler:", err)
+		}
+		return nil
+	}
+	if h.player.Mastering != nil {
+		c = h.player.Mastering.apply(c)
+	}
+	h.filler, h.fillerVoice = c, voice
+	return c
+}
+
+// sleepUnless waits for d and reports false if stopped was set meanwhile.
+func sleepUnless(d time.Duration, stopped *atomic.Bool) bool {
+	const tick = 10 * time.Millisecond
+	for d > 0 {
+		if stopped.Load() {
+			return false
+		}
+		step := tick
+		if d < step {
+			step = d
+		}
+		time.Sleep(step)
+		d -= step
+	}
+	return !stopped.Load()
+}
+
+// holdTone is a quiet two-note chime with soft edges.
+func holdTone(format AudioFormat) *clip {
+	const (
+		noteLength = 250 * time.Millisecond
+		level      = -24.0
+		edge       = 30 * time.Millisecond
+	)
+	notes := []float64{660, 880}
+	frames := int(noteLength.Seconds() * float64(format.SampleRate))
+	edgeFrames := int(edge.Seconds() * float64(format.SampleRate))
+	gain := dbToGain(level)
+
+	var x []float64
+	for _, freq := range notes {
+		for i := 0; i < frames; i++ {
+			env := 1.0
+			if i < edgeFrames {
+				env = float64(i) / float64(edgeFrames)
+			} else if frames-i < edgeFrames {
+				env = float64(frames-i) / float64(edgeFrames)
+			}
+			v := gain * env * math.Sin(2*math.Pi*freq*float64(i)/float64(format.SampleRate))
+			for ch := 0; ch < format.Channels; ch++ {
+				x = append(x, v)
+			}
+		}
+	}
+	return &clip{sampleRate: format.SampleRate, channels: format.Channels, pcm: samplesToPCM(fromFloat(x))}
+}
+
+// fadeOut keeps at most d of samples and ramps them down to zero.
+func fadeOut(samples []int16, format AudioFormat, d time.Duration) []int16 {
+	frames := int(d.Seconds() * float64(format.SampleRate))
+	if n := frames * format.Channels; len(samples) > n {
+		samples = samples[:n]
+	}
+	frames = len(samples) / format.Channels
+	out := make([]int16, len(samples))
+	for i := 0; i < frames; i++ {
+		g := 1 - float64(i+1)/float64(frames)
+		for ch := 0; ch < format.Channels; ch++ {
+			j := i*format.Channels + ch
+			out[j] = int16(math.Round(float64(samples[j]) * g))
+		}
+	}
+	return out
+}
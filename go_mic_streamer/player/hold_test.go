@@ -0,0 +1,178 @@
+package player
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingSink struct {
+	bytes int
+	mu    sync.Mutex
+}
+
+func (s *countingSink) Play(format AudioFormat, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += len(b)
+	return nil
+}
+
+func (s *countingSink) Close() error { return nil }
+
+func (s *countingSink) played() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+func TestHoldAudio(t *testing.T) {
+	t.Run("Should stay quiet when stopped before the delay", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &countingSink{}
+		p.Sink = sink
+		h := NewHoldAudio(p, "", 100*time.Millisecond)
+
+		h.Start()
+		time.Sleep(20 * time.Millisecond)
+		h.Stop()
+
+		if got := sink.played(); got != 0 {
+			t.Errorf("got %d bytes, want 0", got)
+		}
+	})
+
+	t.Run("Should play the hold tone after the delay until stopped", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &countingSink{}
+		p.Sink = sink
+		h := NewHoldAudio(p, "", 10*time.Millisecond)
+
+		h.Start()
+		time.Sleep(100 * time.Millisecond)
+		h.Stop()
+		played := sink.played()
+		time.Sleep(50 * time.Millisecond)
+
+		if played == 0 {
+			t.Error("hold tone was not played")
+		}
+		if got := sink.played(); got != played {
+			t.Errorf("sink got %d more bytes after Stop", got-played)
+		}
+	})
+
+	t.Run("Should call OnPlay before the hold audio sounds", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &countingSink{}
+		p.Sink = sink
+		h := NewHoldAudio(p, "", 10*time.Millisecond)
+		var calls int32
+		var playedBefore int
+		h.OnPlay = func() {
+			atomic.AddInt32(&calls, 1)
+			playedBefore = sink.played()
+		}
+
+		h.Start()
+		time.Sleep(50 * time.Millisecond)
+		h.Stop()
+
+		if got := atomic.LoadInt32(&calls); got != 1 || playedBefore != 0 {
+			t.Errorf("got %d calls after %d bytes, want 1 call before any audio", got, playedBefore)
+		}
+	})
+
+	t.Run("Should call OnStop once the hold audio that played has stopped", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		p.Sink = &countingSink{}
+		var stops int32
+		h := NewHoldAudio(p, "", 10*time.Millisecond)
+		h.OnStop = func() { atomic.AddInt32(&stops, 1) }
+
+		h.Start()
+		time.Sleep(50 * time.Millisecond)
+		h.Stop()
+		if got := atomic.LoadInt32(&stops); got != 1 {
+			t.Errorf("got %d calls, want 1", got)
+		}
+
+		h.Delay = time.Second
+		h.Start()
+		h.Stop()
+		if got := atomic.LoadInt32(&stops); got != 1 {
+			t.Errorf("got %d calls after a hold that never played, want 1", got)
+		}
+	})
+
+	t.Run("Should synthesize the filler again after the voice changed", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		p := NewPlayer(NewVoicevoxClient([]string{server.URL}, time.Second, 0), "")
+		h := NewHoldAudio(p, "少々お待ちください", 0)
+		cached := &clip{sampleRate: 24000, channels: 1}
+		h.filler, h.fillerVoice = cached, p.voice()
+		if got := h.fillerClip(context.Background()); got != cached {
+			t.Fatal("the filler was not reused for the same voice")
+		}
+
+		p.mu.Lock()
+		p.cfg.speaker = 1
+		p.mu.Unlock()
+		if got := h.fillerClip(context.Background()); got == cached {
+			t.Error("the filler of the old voice was reused")
+		}
+	})
+
+	t.Run("Should not wait for a slow filler synthesis when stopped", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}))
+		defer server.Close()
+
+		p := NewPlayer(NewVoicevoxClient([]string{server.URL}, 5*time.Second, 0), "")
+		p.Sink = &countingSink{}
+		h := NewHoldAudio(p, "少々お待ちください", 0)
+
+		h.Start()
+		time.Sleep(20 * time.Millisecond)
+		start := time.Now()
+		h.Stop()
+
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Stop took %v", elapsed)
+		}
+	})
+}
+
+func TestFadeOut(t *testing.T) {
+	t.Run("Should ramp down to silence within the fade length", func(t *testing.T) {
+		format := AudioFormat{SampleRate: 1000, Channels: 2}
+		samples := make([]int16, 200)
+		for i := range samples {
+			samples[i] = 1000
+		}
+
+		got := fadeOut(samples, format, 10*time.Millisecond)
+
+		if len(got) != 20 {
+			t.Fatalf("got %d samples, want 20", len(got))
+		}
+		if got[0] >= 1000 || got[0] != got[1] {
+			t.Errorf("first frame %v", got[:2])
+		}
+		if got[18] != 0 || got[19] != 0 {
+			t.Errorf("last frame %v, want silence", got[18:])
+		}
+	})
+}
@@ -0,0 +1,345 @@
+package player
+
+import (
+	"math"
+	"time"
+)
+
+// Mastering evens out clips from different speakers and styles before they
+// are played: padded silence is trimmed and the clip is brought to a target
+// integrated loudness with a true-peak limiter.
+type Mastering struct {
+	// SilenceThreshold in dBFS; quieter frames at either end count as silence.
+	SilenceThreshold float64
+	// SilenceMargin is the silence kept before and after the speech.
+	SilenceMargin time.Duration
+	// TargetLoudness in LUFS. Zero disables loudness normalization.
+	TargetLoudness float64
+	// TruePeak is the limiter ceiling in dBTP.
+	TruePeak float64
+}
+
+func DefaultMastering() *Mastering {
+	return &Mastering{
+		SilenceThreshold: -50,
+		SilenceMargin:    80 * time.Millisecond,
+		TargetLoudness:   -18,
+		TruePeak:         -1,
+	}
+}
+
+// apply leaves the raw frames of c, such as markup tones, at their own level
+// and measures the loudness without them.
+func (m *Mastering) apply(c *clip) *clip {
+	samples := pcmToSamples(c.pcm)
+	out := &clip{sampleRate: c.sampleRate, channels: c.channels, timing: c.timing, raw: c.raw}
+
+	if m.SilenceThreshold < 0 {
+		var lead time.Duration
+		samples, lead = trimSilence(samples, c.channels, c.sampleRate, m.SilenceThreshold, m.SilenceMargin)
+		out.timing = shiftTiming(c.timing, -lead)
+		out.raw = shiftFrames(c.raw, -int(lead.Seconds()*float64(c.sampleRate)+0.5), len(samples)/c.channels)
+	}
+
+	if m.TargetLoudness < 0 {
+		x := toFloat(samples)
+		speech := append([]float64{}, x...)
+		for _, r := range out.raw {
+			for i := r.start * c.channels; i < r.end*c.channels; i++ {
+				speech[i] = 0
+			}
+		}
+		loudness := integratedLoudness(speech, c.channels, c.sampleRate)
+		if !math.IsInf(loudness, -1) {
+			gain := dbToGain(m.TargetLoudness - loudness)
+			for i := range x {
+				x[i] *= gain
+			}
+			limitTruePeak(x, c.channels, c.sampleRate, dbToGain(m.TruePeak))
+			mastered := fromFloat(x)
+			for _, r := range out.raw {
+				copy(mastered[r.start*c.channels:r.end*c.channels], samples[r.start*c.channels:r.end*c.channels])
+			}
+			samples = mastered
+		}
+	}
+
+	out.pcm = samplesToPCM(samples)
+	return out
+}
+
+// trimSilence drops leading and trailing frames below threshold, keeping
+// margin of audio on each side. It returns the trimmed samples and how much
+// was cut from the start.
+func trimSilence(samples []int16, channels int, rate int, threshold float64, margin time.Duration) ([]int16, time.Duration) {
+	level := int16(dbToGain(threshold) * 32767)
+	frames := len(samples) / channels
+	loud := func(frame int) bool {
+		for ch := 0; ch < channels; ch++ {
+			s := samples[frame*channels+ch]
+			if s > level || s < -level {
+				return true
+			}
+		}
+		return false
+	}
+
+	first := 0
+	for first < frames && !loud(first) {
+		first++
+	}
+	if first == frames {
+		return samples[:0], 0
+	}
+	last := frames - 1
+	for last > first && !loud(last) {
+		last--
+	}
+
+	marginFrames := int(margin.Seconds() * float64(rate))
+	start := first - marginFrames
+	if start < 0 {
+		start = 0
+	}
+	end := last + 1 + marginFrames
+	if end > frames {
+		end = frames
+	}
+	return samples[start*channels : end*channels], time.Duration(start) * time.Second / time.Duration(rate)
+}
+
+func shiftTiming(events []TimingEvent, d time.Duration) []TimingEvent {
+	if d == 0 || len(events) == 0 {
+		return events
+	}
+	out := make([]TimingEvent, len(events))
+	for i, ev := range events {
+		ev.Start += d
+		ev.End += d
+		if ev.Start < 0 {
+			ev.Start = 0
+		}
+		if ev.End < 0 {
+			ev.End = 0
+		}
+		out[i] = ev
+	}
+	return out
+}
+
+// shiftFrames moves ranges by d frames and clips them to frames, dropping
+// those left empty.
+func shiftFrames(ranges []frameRange, d int, frames int) []frameRange {
+	var out []frameRange
+	for _, r := range ranges {
+		r.start += d
+		r.end += d
+		if r.start < 0 {
+			r.start = 0
+		}
+		if r.end > frames {
+			r.end = frames
+		}
+		if r.start < r.end {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// integratedLoudness measures LUFS following ITU-R BS.1770: K-weighting,
+// 400 ms blocks with 75% overlap, an absolute gate at -70 LUFS and a
+// relative gate 10 LU below the ungated loudness.
+func integratedLoudness(x []float64, channels int, rate int) float64 {
+	weighted := kWeight(x, channels, rate)
+	frames := len(weighted) / channels
+	block := int(0.4 * float64(rate))
+	step := block / 4
+	if frames < block {
+		block = frames
+		step = frames
+	}
+	if block == 0 {
+		return math.Inf(-1)
+	}
+
+	var powers []float64
+	for start := 0; start+block <= frames; start += step {
+		var sum float64
+		for i := start * channels; i < (start+block)*channels; i++ {
+			sum += weighted[i] * weighted[i]
+		}
+		// 各チャンネルの平均二乗の和 (L/R の重みは 1.0)
+		powers = append(powers, sum/float64(block))
+	}
+
+	gated := func(threshold float64) float64 {
+		var sum float64
+		n := 0
+		for _, p := range powers {
+			if powerToLUFS(p) > threshold {
+				sum += p
+				n++
+			}
+		}
+		if n == 0 {
+			return math.Inf(-1)
+		}
+		return powerToLUFS(sum / float64(n))
+	}
+
+	ungated := gated(-70)
+	if math.IsInf(ungated, -1) {
+		return ungated
+	}
+	return gated(ungated - 10)
+}
+
+func powerToLUFS(p float64) float64 {
+	return -0.691 + 10*math.Log10(p)
+}
+
+// kWeight applies the BS.1770 pre-filter (high shelf) and RLB high-pass,
+// with coefficients derived for the clip's sample rate.
+func kWeight(x []float64, channels int, rate int) []float64 {
+	fs := float64(rate)
+	shelf := highShelf(fs, 1681.974450955533, 3.999843853973347, 0.7071752369554196)
+	highPass := highPass(fs, 38.13547087602444, 0.5003270373238773)
+
+	out := make([]float64, len(x))
+	for ch := 0; ch < channels; ch++ {
+		s1, s2 := shelf, highPass
+		for i := ch; i < len(x); i += channels {
+			out[i] = s2.process(s1.process(x[i]))
+		}
+	}
+	return out
+}
+
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+func highShelf(fs float64, f0 float64, gainDB float64, q float64) biquad {
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, gainDB/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	return biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+}
+
+func highPass(fs float64, f0 float64, q float64) biquad {
+	k := math.Tan(math.Pi * f0 / fs)
+	a0 := 1 + k/q + k*k
+	return biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+}
+
+// limitTruePeak keeps inter-sample peaks, estimated with 4x Catmull-Rom
+// oversampling, under ceiling. Gain reduction starts 5 ms ahead of a peak and
+// recovers over 50 ms so the limiter does not click.
+func limitTruePeak(x []float64, channels int, rate int, ceiling float64) {
+	frames := len(x) / channels
+	if frames == 0 {
+		return
+	}
+	gains := make([]float64, frames)
+	for i := range gains {
+		gains[i] = 1
+	}
+	for ch := 0; ch < channels; ch++ {
+		at := func(i int) float64 {
+			if i < 0 {
+				i = 0
+			}
+			if i >= frames {
+				i = frames - 1
+			}
+			return x[i*channels+ch]
+		}
+		for i := 0; i < frames; i++ {
+			peak := math.Abs(at(i))
+			p0, p1, p2, p3 := at(i-1), at(i), at(i+1), at(i+2)
+			for k := 1; k < 4; k++ {
+				t := float64(k) / 4
+				v := 0.5 * (2*p1 + (-p0+p2)*t + (2*p0-5*p1+4*p2-p3)*t*t + (-p0+3*p1-3*p2+p3)*t*t*t)
+				if math.Abs(v) > peak {
+					peak = math.Abs(v)
+				}
+			}
+			if peak > ceiling && ceiling/peak < gains[i] {
+				gains[i] = ceiling / peak
+			}
+		}
+	}
+
+	lookahead := rate * 5 / 1000
+	release := math.Exp(-1 / (0.05 * float64(rate)))
+	smoothed := make([]float64, frames)
+	// 先読み区間の最小ゲインを取り、ピーク前から下げ始める
+	for i := range smoothed {
+		g := 1.0
+		for j := i; j < frames && j <= i+lookahead; j++ {
+			if gains[j] < g {
+				g = gains[j]
+			}
+		}
+		smoothed[i] = g
+	}
+	env := 1.0
+	for i := 0; i < frames; i++ {
+		if smoothed[i] < env {
+			env = smoothed[i]
+		} else {
+			env = smoothed[i] + (env-smoothed[i])*release
+		}
+		for ch := 0; ch < channels; ch++ {
+			x[i*channels+ch] *= env
+		}
+	}
+}
+
+func dbToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+func toFloat(samples []int16) []float64 {
+	x := make([]float64, len(samples))
+	for i, s := range samples {
+		x[i] = float64(s) / 32768
+	}
+	return x
+}
+
+func fromFloat(x []float64) []int16 {
+	samples := make([]int16, len(x))
+	for i, v := range x {
+		v *= 32768
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		samples[i] = int16(math.Round(v))
+	}
+	return samples
+}
@@ -0,0 +1,91 @@
+package player
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func sine(freq float64, amplitude float64, rate int, d time.Duration) []int16 {
+	n := int(d.Seconds() * float64(rate))
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = int16(amplitude * 32767 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+func TestIntegratedLoudness(t *testing.T) {
+	t.Run("Should measure a full scale 997Hz sine at about -3 LUFS", func(t *testing.T) {
+		x := toFloat(sine(997, 1.0, 48000, 2*time.Second))
+
+		got := integratedLoudness(x, 1, 48000)
+		if math.Abs(got-(-3.01)) > 0.1 {
+			t.Errorf("got %.2f LUFS, want -3.01", got)
+		}
+	})
+
+	t.Run("Should return -Inf for digital silence", func(t *testing.T) {
+		got := integratedLoudness(make([]float64, 24000), 1, 24000)
+		if !math.IsInf(got, -1) {
+			t.Errorf("got %v, want -Inf", got)
+		}
+	})
+}
+
+func TestMastering(t *testing.T) {
+	rate := 24000
+	padding := make([]int16, rate/2)
+	speech := sine(440, 0.05, rate, time.Second)
+	samples := append(append(append([]int16{}, padding...), speech...), padding...)
+	c := &clip{
+		sampleRate: rate,
+		channels:   1,
+		pcm:        samplesToPCM(samples),
+		timing:     []TimingEvent{{TimingWord, "ア", 500 * time.Millisecond, 1500 * time.Millisecond}},
+	}
+	m := DefaultMastering()
+
+	got := m.apply(c)
+
+	t.Run("Should trim silence beyond the margin", func(t *testing.T) {
+		want := time.Second + 2*m.SilenceMargin
+		if d := got.duration() - want; d > 5*time.Millisecond || d < -5*time.Millisecond {
+			t.Errorf("got %v, want %v", got.duration(), want)
+		}
+		if start := got.timing[0].Start; start-m.SilenceMargin > time.Millisecond || m.SilenceMargin-start > time.Millisecond {
+			t.Errorf("got timing start %v, want %v", start, m.SilenceMargin)
+		}
+	})
+
+	t.Run("Should normalize to the target loudness under the peak ceiling", func(t *testing.T) {
+		x := toFloat(pcmToSamples(got.pcm))
+		loudness := integratedLoudness(x, 1, rate)
+		if math.Abs(loudness-m.TargetLoudness) > 0.5 {
+			t.Errorf("got %.2f LUFS, want %.2f", loudness, m.TargetLoudness)
+		}
+		for _, v := range x {
+			if math.Abs(v) > dbToGain(m.TruePeak)+0.001 {
+				t.Fatalf("sample %v exceeds the ceiling", v)
+			}
+		}
+	})
+}
+
+func TestLimitTruePeak(t *testing.T) {
+	t.Run("Should pull peaks under the ceiling", func(t *testing.T) {
+		x := toFloat(sine(1000, 1.0, 24000, 100*time.Millisecond))
+		for i := range x {
+			x[i] *= 2
+		}
+		ceiling := dbToGain(-1)
+
+		limitTruePeak(x, 1, 24000, ceiling)
+
+		for i, v := range x {
+			if math.Abs(v) > ceiling+1e-9 {
+				t.Fatalf("sample %d = %v exceeds %v", i, v, ceiling)
+			}
+		}
+	})
+}
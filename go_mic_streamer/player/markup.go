@@ -0,0 +1,270 @@
+package player
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Speech markup lets the backend control prosody per phrase:
+//
+//	こちらは<emph>首無商事</emph>です。<pause 500ms><speed 0.8>ゆっくり話します。</speed>
+//
+// Supported tags are <pause DURATION>, <speed RATE>...</speed>,
+// <pitch OFFSET>...</pitch>, <volume RATE>...</volume>, <emph>...</emph> and
+// <style NAME_OR_ID>...</style>. <tone ringback|busy|beep> and <dtmf DIGITS>
+// play a tone at that point of the utterance. Anything else, including a
+// bare "<", is spoken as text.
+
+// prosody is the accumulated effect of the open tags around a segment.
+type prosody struct {
+	speed    float64
+	pitch    float64
+	volume   float64
+	emphasis bool
+	style    string
+}
+
+type speechSegment struct {
+	text    string
+	prosody prosody
+	// pause is the silence inserted after the text.
+	pause time.Duration
+	// tone is played instead of text when set.
+	tone *Tone
+}
+
+var markupTags = map[string]bool{
+	"pause":  true,
+	"speed":  true,
+	"pitch":  true,
+	"volume": true,
+	"emph":   true,
+	"style":  true,
+	"tone":   true,
+	"dtmf":   true,
+}
+
+// parseMarkup splits text into segments with uniform prosody. Plain text
+// yields exactly one segment.
+func parseMarkup(text string) ([]speechSegment, error) {
+	var segments []speechSegment
+	stack := []prosody{{speed: 1.0, volume: 1.0}}
+	var openTags []string
+	var buf strings.Builder
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		segments = append(segments, speechSegment{text: buf.String(), prosody: stack[len(stack)-1]})
+		buf.Reset()
+	}
+
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '<')
+		if i < 0 {
+			buf.WriteString(text)
+			break
+		}
+		buf.WriteString(text[:i])
+		text = text[i:]
+
+		end := strings.IndexByte(text, '>')
+		if end < 0 {
+			buf.WriteString(text)
+			break
+		}
+		inner := text[1:end]
+		closing := strings.HasPrefix(inner, "/")
+		name, arg, _ := strings.Cut(strings.TrimPrefix(inner, "/"), " ")
+		arg = strings.TrimSpace(arg)
+		if !markupTags[name] {
+			buf.WriteString("<")
+			text = text[1:]
+			continue
+		}
+		text = text[end+1:]
+
+		if closing {
+			if len(openTags) == 0 || openTags[len(openTags)-1] != name {
+				return nil, fmt.Errorf("markup: unexpected </%s>", name)
+			}
+			flush()
+			openTags = openTags[:len(openTags)-1]
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if name == "pause" {
+			d, err := parsePause(arg)
+			if err != nil {
+				return nil, err
+			}
+			flush()
+			if len(segments) == 0 {
+				segments = append(segments, speechSegment{prosody: stack[len(stack)-1]})
+			}
+			segments[len(segments)-1].pause += d
+			continue
+		}
+
+		if name == "tone" || name == "dtmf" {
+			t, err := parseTone(name, arg)
+			if err != nil {
+				return nil, err
+			}
+			flush()
+			segments = append(segments, speechSegment{prosody: stack[len(stack)-1], tone: &t})
+			continue
+		}
+
+		p := stack[len(stack)-1]
+		if err := p.apply(name, arg); err != nil {
+			return nil, err
+		}
+		flush()
+		stack = append(stack, p)
+		openTags = append(openTags, name)
+	}
+	if len(openTags) > 0 {
+		return nil, fmt.Errorf("markup: <%s> is not closed", openTags[len(openTags)-1])
+	}
+	flush()
+	return segments, nil
+}
+
+func (p *prosody) apply(name string, arg string) error {
+	if name == "emph" {
+		p.emphasis = true
+		return nil
+	}
+	if arg == "" {
+		return fmt.Errorf("markup: <%s> needs a value", name)
+	}
+	if name == "style" {
+		p.style = arg
+		return nil
+	}
+	v, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return fmt.Errorf("markup: invalid <%s %s>", name, arg)
+	}
+	switch name {
+	case "speed":
+		if v <= 0 {
+			return fmt.Errorf("markup: invalid <speed %s>", arg)
+		}
+		p.speed *= v
+	case "pitch":
+		p.pitch += v
+	case "volume":
+		p.volume *= v
+	}
+	return nil
+}
+
+func parsePause(arg string) (time.Duration, error) {
+	if arg == "" {
+		return 0, fmt.Errorf("markup: <pause> needs a duration")
+	}
+	if ms, err := strconv.Atoi(arg); err == nil {
+		if ms < 0 {
+			return 0, fmt.Errorf("markup: invalid <pause %s>", arg)
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("markup: invalid <pause %s>", arg)
+	}
+	return d, nil
+}
+
+func parseTone(name string, arg string) (Tone, error) {
+	if arg == "" {
+		return Tone{}, fmt.Errorf("markup: <%s> needs a value", name)
+	}
+	var t Tone
+	var err error
+	if name == "dtmf" {
+		t, err = DTMFTone(arg)
+	} else {
+		t, err = ToneByName(arg)
+	}
+	if err != nil {
+		return Tone{}, fmt.Errorf("markup: %v", err)
+	}
+	return t, nil
+}
+
+// applyProsody adjusts the audio query of a segment: global scales are
+// multiplied, emphasis raises the intonation and the pitch of accented moras,
+// and a trailing pause becomes the pause mora of the last accent phrase.
+func applyProsody(params *Params, seg speechSegment) {
+	params.SpeedScale *= seg.prosody.speed
+	params.PitchScale += seg.prosody.pitch
+	params.VolumeScale *= seg.prosody.volume
+
+	if seg.prosody.emphasis {
+		params.IntonationScale *= 1.4
+		for i := range params.AccentPhrases {
+			phrase := &params.AccentPhrases[i]
+			for j := range phrase.Moras {
+				if j < phrase.Accent && phrase.Moras[j].Pitch > 0 {
+					phrase.Moras[j].Pitch += 0.15
+				}
+			}
+		}
+	}
+
+	if seg.pause > 0 && len(params.AccentPhrases) > 0 {
+		last := &params.AccentPhrases[len(params.AccentPhrases)-1]
+		// speedScale で割られるので、指定時間になるよう補正する
+		length := seg.pause.Seconds() * params.SpeedScale
+		last.PauseMora = &Mora{Text: "、", Vowel: "pau", VowelLength: length}
+	}
+}
+
+// stripMarkup returns the spoken text of a marked up string.
+func stripMarkup(text string) string {
+	segments, err := parseMarkup(text)
+	if err != nil {
+		return stripTags(text)
+	}
+	var b strings.Builder
+	for _, seg := range segments {
+		b.WriteString(seg.text)
+	}
+	return b.String()
+}
+
+// stripTags removes every markup tag, balanced or not, for text whose markup
+// could not be parsed. Text that only looks like a tag is kept as in
+// parseMarkup.
+func stripTags(text string) string {
+	var b strings.Builder
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '<')
+		if i < 0 {
+			b.WriteString(text)
+			break
+		}
+		b.WriteString(text[:i])
+		text = text[i:]
+		end := strings.IndexByte(text, '>')
+		if end < 0 {
+			b.WriteString(text)
+			break
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(text[1:end], "/"), " ")
+		if !markupTags[name] {
+			b.WriteString("<")
+			text = text[1:]
+			continue
+		}
+		text = text[end+1:]
+	}
+	return b.String()
+}
@@ -0,0 +1,109 @@
+package player
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMarkup(t *testing.T) {
+	plain := prosody{speed: 1.0, volume: 1.0}
+
+	tests := []struct {
+		name  string
+		input string
+		want  []speechSegment
+	}{
+		{
+			"Should keep plain text as one segment",
+			"お電話ありがとうございます。",
+			[]speechSegment{{text: "お電話ありがとうございます。", prosody: plain}},
+		},
+		{
+			"Should treat unknown tags as text",
+			"1 < 2 と <b>太字</b>",
+			[]speechSegment{{text: "1 < 2 と <b>太字</b>", prosody: plain}},
+		},
+		{
+			"Should nest prosody tags",
+			"はい。<speed 0.8>ゆっくり<volume 1.5>大きく</volume></speed>",
+			[]speechSegment{
+				{text: "はい。", prosody: plain},
+				{text: "ゆっくり", prosody: prosody{speed: 0.8, volume: 1.0}},
+				{text: "大きく", prosody: prosody{speed: 0.8, volume: 1.5}},
+			},
+		},
+		{
+			"Should attach pauses to the preceding segment",
+			"<pause 200>少々<pause 0.5s>お待ちください",
+			[]speechSegment{
+				{prosody: plain, pause: 200 * time.Millisecond},
+				{text: "少々", prosody: plain, pause: 500 * time.Millisecond},
+				{text: "お待ちください", prosody: plain},
+			},
+		},
+		{
+			"Should switch style and emphasis",
+			"<style ささやき>ここだけの<emph>話</emph></style>",
+			[]speechSegment{
+				{text: "ここだけの", prosody: prosody{speed: 1.0, volume: 1.0, style: "ささやき"}},
+				{text: "話", prosody: prosody{speed: 1.0, volume: 1.0, style: "ささやき", emphasis: true}},
+			},
+		},
+		{
+			"Should queue tones between the spoken text",
+			"録音を開始します<tone beep><pause 300>どうぞ",
+			[]speechSegment{
+				{text: "録音を開始します", prosody: plain},
+				{prosody: plain, tone: &BeepTone, pause: 300 * time.Millisecond},
+				{text: "どうぞ", prosody: plain},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMarkup(tt.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Should reject unbalanced tags and invalid values", func(t *testing.T) {
+		for _, input := range []string{"<speed 1.2>速く", "遅く</speed>", "<pitch>高く</pitch>", "<dtmf 12x>", "<tone siren>", "<pause -5>", "<pause -1s>"} {
+			if _, err := parseMarkup(input); err == nil {
+				t.Errorf("expected an error for %q", input)
+			}
+		}
+	})
+}
+
+func TestStripTags(t *testing.T) {
+	t.Run("Should drop the tags of invalid markup and keep the text", func(t *testing.T) {
+		got := stripTags("<speed 1.2>速く<pause 1x>ね</pitch> 1 < 2 と <b>太字</b>")
+		if want := "速くね 1 < 2 と <b>太字</b>"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestApplyProsody(t *testing.T) {
+	t.Run("Should set the pause mora of the last accent phrase", func(t *testing.T) {
+		params := &Params{SpeedScale: 1.0, VolumeScale: 1.0, IntonationScale: 1.0, AccentPhrases: make([]AccentPhrases, 2)}
+		seg := speechSegment{text: "少々", prosody: prosody{speed: 2.0, volume: 1.0}, pause: 500 * time.Millisecond}
+
+		applyProsody(params, seg)
+
+		if params.SpeedScale != 2.0 {
+			t.Errorf("got speed %v, want %v", params.SpeedScale, 2.0)
+		}
+		pause := params.AccentPhrases[1].PauseMora
+		if pause == nil || pause.VowelLength != 1.0 {
+			t.Errorf("got pause mora %+v, want vowel length 1.0", pause)
+		}
+	})
+}
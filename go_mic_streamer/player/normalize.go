@@ -0,0 +1,291 @@
+package player
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Normalizer rewrites text that VOICEVOX tends to misread (phone numbers,
+// dates, times, prices, units, URLs and Latin words) into readings it
+// pronounces naturally.
+type Normalizer struct {
+	// English maps lower-case Latin words to their katakana reading.
+	English map[string]string
+}
+
+func NewNormalizer() *Normalizer {
+	n := &Normalizer{English: map[string]string{}}
+	for word, kana := range defaultEnglish {
+		n.English[word] = kana
+	}
+	return n
+}
+
+var defaultEnglish = map[string]string{
+	"ai":       "エーアイ",
+	"api":      "エーピーアイ",
+	"app":      "アプリ",
+	"com":      "コム",
+	"email":    "イーメール",
+	"faq":      "エフエーキュー",
+	"google":   "グーグル",
+	"http":     "エイチティーティーピー",
+	"https":    "エイチティーティーピーエス",
+	"line":     "ライン",
+	"mail":     "メール",
+	"ng":       "エヌジー",
+	"ok":       "オーケー",
+	"online":   "オンライン",
+	"pc":       "ピーシー",
+	"pdf":      "ピーディーエフ",
+	"support":  "サポート",
+	"voicevox": "ボイスボックス",
+	"web":      "ウェブ",
+	"wifi":     "ワイファイ",
+	"wi-fi":    "ワイファイ",
+	"www":      "ダブリューダブリューダブリュー",
+	"zoom":     "ズーム",
+}
+
+var letterKana = map[rune]string{
+	'a': "エー", 'b': "ビー", 'c': "シー", 'd': "ディー", 'e': "イー", 'f': "エフ",
+	'g': "ジー", 'h': "エイチ", 'i': "アイ", 'j': "ジェー", 'k': "ケー", 'l': "エル",
+	'm': "エム", 'n': "エヌ", 'o': "オー", 'p': "ピー", 'q': "キュー", 'r': "アール",
+	's': "エス", 't': "ティー", 'u': "ユー", 'v': "ブイ", 'w': "ダブリュー", 'x': "エックス",
+	'y': "ワイ", 'z': "ゼット",
+}
+
+var digitKana = []string{"ゼロ", "イチ", "ニー", "サン", "ヨン", "ゴー", "ロク", "ナナ", "ハチ", "キュー"}
+
+var unitReadings = map[string]string{
+	"km": "キロメートル",
+	"kg": "キログラム",
+	"cm": "センチメートル",
+	"mm": "ミリメートル",
+	"ml": "ミリリットル",
+	"m":  "メートル",
+	"g":  "グラム",
+	"GB": "ギガバイト",
+	"MB": "メガバイト",
+	"KB": "キロバイト",
+	"ms": "ミリ秒",
+	"%":  "パーセント",
+	"℃":  "度",
+	"°C": "度",
+	"円":  "円",
+	"ドル": "ドル",
+}
+
+var (
+	urlRe    = regexp.MustCompile(`https?://[A-Za-z0-9\-._~/?#@!$&'()*+,;=%:]+`)
+	phoneRe  = regexp.MustCompile(`(?:\+81[- ]?|\b0)\d{1,4}-\d{1,4}-\d{3,4}\b|\b0[5789]0\d{8}\b`)
+	dateRe   = regexp.MustCompile(`\b(\d{4})[/-](\d{1,2})[/-](\d{1,2})\b`)
+	timeRe   = regexp.MustCompile(`\b(\d{1,2}):(\d{2})\b`)
+	yenRe    = regexp.MustCompile(`[¥￥]\s?(\d[\d,]*)`)
+	dollarRe = regexp.MustCompile(`\$\s?(\d[\d,]*(?:\.\d+)?)`)
+	unitRe   = regexp.MustCompile(`(\d[\d,]*(?:\.\d+)?)\s?(km|kg|cm|mm|ml|GB|MB|KB|ms|m|g|%|℃|°C|円|ドル)([^A-Za-z]|$)`)
+	numberRe = regexp.MustCompile(`\d[\d,]*(?:\.\d+)?`)
+	latinRe  = regexp.MustCompile(`[A-Za-z][A-Za-z\-']*`)
+)
+
+// Normalize applies every rule in order. Earlier rules leave no digits or
+// Latin letters behind, so later rules do not see their output.
+func (n *Normalizer) Normalize(text string) string {
+	text = urlRe.ReplaceAllStringFunc(text, n.readURL)
+	text = phoneRe.ReplaceAllStringFunc(text, readPhoneNumber)
+	text = dateRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := dateRe.FindStringSubmatch(s)
+		month, _ := strconv.Atoi(m[2])
+		day, _ := strconv.Atoi(m[3])
+		if month < 1 || month > 12 || day < 1 || day > 31 {
+			return s
+		}
+		return m[1] + "年" + strconv.Itoa(month) + "月" + strconv.Itoa(day) + "日"
+	})
+	text = timeRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := timeRe.FindStringSubmatch(s)
+		hour, _ := strconv.Atoi(m[1])
+		minute, _ := strconv.Atoi(m[2])
+		if hour > 24 || minute > 59 {
+			return s
+		}
+		if minute == 0 {
+			return strconv.Itoa(hour) + "時"
+		}
+		return strconv.Itoa(hour) + "時" + strconv.Itoa(minute) + "分"
+	})
+	text = yenRe.ReplaceAllString(text, "${1}円")
+	text = dollarRe.ReplaceAllString(text, "${1}ドル")
+	text = unitRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := unitRe.FindStringSubmatch(s)
+		return readNumber(m[1]) + unitReadings[m[2]] + m[3]
+	})
+	text = numberRe.ReplaceAllStringFunc(text, readNumber)
+	text = latinRe.ReplaceAllStringFunc(text, n.readLatin)
+	return text
+}
+
+func readPhoneNumber(s string) string {
+	if strings.HasPrefix(s, "+81") {
+		s = "0" + strings.TrimLeft(s[3:], "- ")
+	}
+	groups := strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == ' ' })
+	if len(groups) == 1 && len(s) == 11 {
+		// 携帯番号は 3-4-4 で区切って読む
+		groups = []string{s[:3], s[3:7], s[7:]}
+	}
+	var readings []string
+	for _, g := range groups {
+		var b strings.Builder
+		for _, d := range g {
+			b.WriteString(digitKana[d-'0'])
+		}
+		readings = append(readings, b.String())
+	}
+	// 読点でグループ間に自然な間を入れる
+	return strings.Join(readings, "、")
+}
+
+func (n *Normalizer) readURL(s string) string {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+	s = strings.TrimRight(s, "/.,")
+	var parts []string
+	for _, r := range s {
+		switch r {
+		case '.':
+			parts = append(parts, "ドット")
+		case '/':
+			parts = append(parts, "スラッシュ")
+		case '-':
+			parts = append(parts, "ハイフン")
+		case '_':
+			parts = append(parts, "アンダーバー")
+		default:
+			if len(parts) > 0 && !isURLSeparator(parts[len(parts)-1]) {
+				parts[len(parts)-1] += string(r)
+			} else {
+				parts = append(parts, string(r))
+			}
+		}
+	}
+	for i, p := range parts {
+		if isURLSeparator(p) {
+			continue
+		}
+		if strings.Trim(p, "0123456789") == "" {
+			parts[i] = readDigits(p)
+			continue
+		}
+		if _, ok := n.English[strings.ToLower(p)]; !ok && len(p) <= 3 {
+			// co, jp などのドメインの短い区切りは綴りで読む
+			parts[i] = spellLetters(p)
+			continue
+		}
+		parts[i] = n.readLatin(p)
+	}
+	return strings.Join(parts, "")
+}
+
+func isURLSeparator(s string) bool {
+	return s == "ドット" || s == "スラッシュ" || s == "ハイフン" || s == "アンダーバー"
+}
+
+// readLatin looks the word up in the English dictionary; unknown acronyms
+// (all capitals, or anything that is not pronounceable as a word) are spelled out.
+func (n *Normalizer) readLatin(word string) string {
+	if kana, ok := n.English[strings.ToLower(word)]; ok {
+		return kana
+	}
+	if strings.ToUpper(word) == word && len(word) <= 6 {
+		return spellLetters(word)
+	}
+	if !strings.ContainsAny(strings.ToLower(word), "aeiouy") {
+		return spellLetters(word)
+	}
+	return word
+}
+
+func spellLetters(word string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(word) {
+		if kana, ok := letterKana[r]; ok {
+			b.WriteString(kana)
+		} else if r >= '0' && r <= '9' {
+			b.WriteString(digitKana[r-'0'])
+		}
+	}
+	return b.String()
+}
+
+func readDigits(s string) string {
+	var b strings.Builder
+	for _, d := range s {
+		if d >= '0' && d <= '9' {
+			b.WriteString(digitKana[d-'0'])
+		}
+	}
+	return b.String()
+}
+
+// readNumber converts "1,234.5" into "千二百三十四点五".
+func readNumber(s string) string {
+	s = strings.ReplaceAll(s, ",", "")
+	integer, fraction, hasFraction := strings.Cut(s, ".")
+	n, err := strconv.ParseInt(integer, 10, 64)
+	if err != nil || len(integer) > 16 {
+		return readDigits(s)
+	}
+	out := kanjiNumber(n)
+	if hasFraction {
+		out += "点"
+		for _, d := range fraction {
+			out += kanjiDigits[d-'0']
+		}
+	}
+	return out
+}
+
+var kanjiDigits = []string{"零", "一", "二", "三", "四", "五", "六", "七", "八", "九"}
+var kanjiLargeUnits = []string{"", "万", "億", "兆"}
+
+func kanjiNumber(n int64) string {
+	if n == 0 {
+		return kanjiDigits[0]
+	}
+	var out string
+	for i := 0; n > 0 && i < len(kanjiLargeUnits); i++ {
+		group := n % 10000
+		n /= 10000
+		if group == 0 {
+			continue
+		}
+		out = kanjiGroup(group, i > 0) + kanjiLargeUnits[i] + out
+	}
+	return out
+}
+
+// kanjiGroup reads a number below 10000. "一" is dropped before 十, 百 and 千,
+// except 一千 in front of a large unit (一千万).
+func kanjiGroup(n int64, beforeLargeUnit bool) string {
+	var out string
+	units := []struct {
+		value int64
+		name  string
+	}{{1000, "千"}, {100, "百"}, {10, "十"}}
+	for _, u := range units {
+		d := n / u.value
+		n %= u.value
+		if d == 0 {
+			continue
+		}
+		if d > 1 || (u.value == 1000 && beforeLargeUnit) {
+			out += kanjiDigits[d]
+		}
+		out += u.name
+	}
+	if n > 0 {
+		out += kanjiDigits[n]
+	}
+	return out
+}
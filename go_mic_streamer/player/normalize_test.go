@@ -0,0 +1,44 @@
+package player
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain text", "お電話ありがとうございます。", "お電話ありがとうございます。"},
+		{"mobile phone number", "080-1234-5678にお電話ください", "ゼロハチゼロ、イチニーサンヨン、ゴーロクナナハチにお電話ください"},
+		{"phone number without hyphens", "09012345678", "ゼロキューゼロ、イチニーサンヨン、ゴーロクナナハチ"},
+		{"landline with country code", "+81-3-1234-5678", "ゼロサン、イチニーサンヨン、ゴーロクナナハチ"},
+		{"toll free number", "0120-123-456", "ゼロイチニーゼロ、イチニーサン、ヨンゴーロク"},
+		{"slash date", "2024/5/3に伺います", "二千二十四年五月三日に伺います"},
+		{"iso date", "2024-05-03", "二千二十四年五月三日"},
+		{"time", "14:30から", "十四時三十分から"},
+		{"time on the hour", "9:00", "九時"},
+		{"yen with symbol", "¥1,200です", "千二百円です"},
+		{"yen with suffix", "3,000円", "三千円"},
+		{"dollar", "$5.99", "五点九九ドル"},
+		{"percent", "20%オフ", "二十パーセントオフ"},
+		{"unit", "5kgの荷物", "五キログラムの荷物"},
+		{"large number", "12345678", "一千二百三十四万五千六百七十八"},
+		{"thousand before man", "10000000", "一千万"},
+		{"zero", "0", "零"},
+		{"decimal", "3.14", "三点一四"},
+		{"dictionary word", "AIがOKと言いました", "エーアイがオーケーと言いました"},
+		{"unknown acronym", "NHK", "エヌエイチケー"},
+		{"unknown word", "hello", "hello"},
+		{"url", "https://www.example.co.jp/faq", "ダブリューダブリューダブリュードットexampleドットシーオードットジェーピースラッシュエフエーキュー"},
+	}
+
+	n := NewNormalizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := n.Normalize(tt.input)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
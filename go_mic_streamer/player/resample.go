@@ -0,0 +1,46 @@
+package player
+
+import "encoding/binary"
+
+// pcmToSamples converts 16-bit little endian PCM bytes into samples.
+func pcmToSamples(pcm []byte) []int16 {
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return samples
+}
+
+func samplesToPCM(samples []int16) []byte {
+	pcm := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(s))
+	}
+	return pcm
+}
+
+// resampleLinear converts interleaved samples between rates with linear
+// interpolation. It is meant for speech, not for high fidelity music.
+func resampleLinear(samples []int16, channels int, from int, to int) []int16 {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+	frames := len(samples) / channels
+	outFrames := int(int64(frames) * int64(to) / int64(from))
+	out := make([]int16, outFrames*channels)
+	step := float64(from) / float64(to)
+	for i := 0; i < outFrames; i++ {
+		pos := float64(i) * step
+		j := int(pos)
+		frac := pos - float64(j)
+		for ch := 0; ch < channels; ch++ {
+			a := float64(samples[j*channels+ch])
+			b := a
+			if j+1 < frames {
+				b = float64(samples[(j+1)*channels+ch])
+			}
+			out[i*channels+ch] = int16(a + (b-a)*frac)
+		}
+	}
+	return out
+}
@@ -0,0 +1,255 @@
+package player
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/oto"
+)
+
+// AudioFormat describes 16-bit little endian PCM.
+type AudioFormat struct {
+	SampleRate int
+	Channels   int
+}
+
+// Sink is where the player sends audio. Play blocks until b has been handed
+// to the output; an utterance may arrive as several consecutive Play calls.
+type Sink interface {
+	Play(format AudioFormat, b []byte) error
+	Close() error
+}
+
+// Buffering is implemented by sinks that keep playing audio after Play
+// returned. Buffered is how long it takes until everything handed to Play
+// so far has been heard.
+type Buffering interface {
+	Buffered() time.Duration
+}
+
+// playout estimates when the audio handed to an output device has been
+// heard, assuming the device plays it in real time from when it gets it.
+type playout struct {
+	until time.Time
+}
+
+func (p *playout) add(format AudioFormat, n int) {
+	now := time.Now()
+	if p.until.Before(now) {
+		p.until = now
+	}
+	frames := n / (2 * format.Channels)
+	p.until = p.until.Add(time.Duration(frames) * time.Second / time.Duration(format.SampleRate))
+}
+
+func (p *playout) buffered() time.Duration {
+	if d := time.Until(p.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// UtteranceMarker is implemented by sinks that need to know where utterances
+// start and end, e.g. to index them or to flush partial buffers.
+type UtteranceMarker interface {
+	BeginUtterance()
+	EndUtterance() error
+}
+
+// NewSink builds a sink from a spec: "oto" (default device), "portaudio:DEVICE",
+// "wav:PATH", "pcm" (raw PCM to stdout) or "null".
+func NewSink(spec string, audioSystem OutputSystem) (Sink, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "oto":
+		return &OtoSink{}, nil
+	case "portaudio":
+		if arg == "" {
+			return nil, fmt.Errorf("portaudio sink needs a device name, e.g. portaudio:Handset")
+		}
+		return NewPortAudioSink(audioSystem, arg)
+	case "wav":
+		if arg == "" {
+			return nil, fmt.Errorf("wav sink needs a path, e.g. wav:replies.wav")
+		}
+		return NewWAVFileSink(arg)
+	case "pcm":
+		return &WriterSink{Writer: os.Stdout}, nil
+	case "null":
+		return NullSink{}, nil
+	}
+	return nil, fmt.Errorf("unknown output %q", spec)
+}
+
+// OtoSink plays on the default device. The oto context and player are kept
+// open while the format stays the same so consecutive chunks play gaplessly.
+type OtoSink struct {
+	ctx     *oto.Context
+	player  *oto.Player
+	format  AudioFormat
+	playout playout
+	mu      sync.Mutex
+}
+
+func (s *OtoSink) Play(format AudioFormat, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil || s.format != format {
+		s.close()
+		ctx, err := oto.NewContext(format.SampleRate, format.Channels, 2, 3200)
+		if err != nil {
+			return err
+		}
+		s.ctx = ctx
+		s.player = ctx.NewPlayer()
+		s.format = format
+	}
+	s.playout.add(format, len(b))
+	_, err := io.Copy(s.player, bytes.NewReader(b))
+	return err
+}
+
+func (s *OtoSink) Buffered() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.playout.buffered()
+}
+
+func (s *OtoSink) close() error {
+	if s.ctx == nil {
+		return nil
+	}
+	s.player.Close()
+	err := s.ctx.Close()
+	s.ctx = nil
+	s.player = nil
+	return err
+}
+
+func (s *OtoSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close()
+}
+
+// WriterSink writes raw PCM, e.g. to stdout for piping into another tool.
+type WriterSink struct {
+	Writer io.Writer
+}
+
+func (s *WriterSink) Play(format AudioFormat, b []byte) error {
+	_, err := s.Writer.Write(b)
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// NullSink discards audio.
+type NullSink struct{}
+
+func (NullSink) Play(format AudioFormat, b []byte) error { return nil }
+
+func (NullSink) Close() error { return nil }
+
+// WAVFileSink appends every utterance to one WAV file and logs when each one
+// started in PATH.txt. The header is rewritten after each write so the file
+// stays playable while the session is running.
+type WAVFileSink struct {
+	file           *os.File
+	index          *os.File
+	format         AudioFormat
+	dataSize       uint32
+	utteranceStart uint32
+	utteranceTime  time.Time
+	mu             sync.Mutex
+}
+
+const wavHeaderSize = 44
+
+func NewWAVFileSink(path string) (*WAVFileSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.Create(path + ".txt")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &WAVFileSink{file: file, index: index}, nil
+}
+
+func (s *WAVFileSink) Play(format AudioFormat, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.format == (AudioFormat{}) {
+		s.format = format
+	} else if s.format != format {
+		return fmt.Errorf("wav sink: cannot append %dHz/%dch audio to a %dHz/%dch file", format.SampleRate, format.Channels, s.format.SampleRate, s.format.Channels)
+	}
+
+	if _, err := s.file.WriteAt(b, int64(wavHeaderSize)+int64(s.dataSize)); err != nil {
+		return err
+	}
+	s.dataSize += uint32(len(b))
+	_, err := s.file.WriteAt(wavHeader(s.format, s.dataSize), 0)
+	return err
+}
+
+func (s *WAVFileSink) BeginUtterance() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.utteranceStart = s.dataSize
+	s.utteranceTime = time.Now()
+}
+
+func (s *WAVFileSink) EndUtterance() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.format == (AudioFormat{}) {
+		return nil
+	}
+	bytesPerSecond := float64(s.format.SampleRate * s.format.Channels * 2)
+	offset := float64(s.utteranceStart) / bytesPerSecond
+	duration := float64(s.dataSize-s.utteranceStart) / bytesPerSecond
+	_, err := fmt.Fprintf(s.index, "%s offset=%.3fs duration=%.3fs\n", s.utteranceTime.Format(time.RFC3339Nano), offset, duration)
+	return err
+}
+
+func (s *WAVFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	indexErr := s.index.Close()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	return indexErr
+}
+
+func wavHeader(format AudioFormat, dataSize uint32) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, wavHeaderSize))
+	blockAlign := uint16(format.Channels * 2)
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(36)+dataSize)
+	buf.WriteString("WAVEfmt ")
+	binary.Write(buf, binary.LittleEndian, uint32(16))
+	binary.Write(buf, binary.LittleEndian, uint16(1))
+	binary.Write(buf, binary.LittleEndian, uint16(format.Channels))
+	binary.Write(buf, binary.LittleEndian, uint32(format.SampleRate))
+	binary.Write(buf, binary.LittleEndian, uint32(format.SampleRate)*uint32(blockAlign))
+	binary.Write(buf, binary.LittleEndian, blockAlign)
+	binary.Write(buf, binary.LittleEndian, uint16(16))
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, dataSize)
+	return buf.Bytes()
+}
@@ -0,0 +1,143 @@
+package player
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// OutputSystem opens streams on named output devices. The recorder's
+// AudioSystem provides it in cmd, so that the player does not depend on the
+// recorder.
+type OutputSystem interface {
+	Initialize() error
+	Terminate() error
+	// DefaultSampleRate returns the default rate of the device that
+	// OpenOutputStream opens for deviceName.
+	DefaultSampleRate(deviceName string) (int, error)
+	// OpenOutputStream opens a stream whose Write plays buf.
+	OpenOutputStream(deviceName string, channels int, sampleRate float64, framesPerBuffer int, buf []int16) (OutputStream, error)
+}
+
+type OutputStream interface {
+	Start() error
+	Stop() error
+	Write() error
+	Close() error
+}
+
+// PortAudioSink plays on a named output device, e.g. a handset speaker while
+// the room speaker plays other audio.
+type PortAudioSink struct {
+	DeviceName  string
+	audioSystem OutputSystem
+	stream      OutputStream
+	buf         []int16
+	pending     []int16
+	format      AudioFormat
+	deviceRate  int
+	playout     playout
+	mu          sync.Mutex
+}
+
+const portAudioFramesPerBuffer = 512
+
+func NewPortAudioSink(audioSystem OutputSystem, deviceName string) (*PortAudioSink, error) {
+	if err := audioSystem.Initialize(); err != nil {
+		return nil, err
+	}
+	return &PortAudioSink{DeviceName: deviceName, audioSystem: audioSystem}, nil
+}
+
+func (s *PortAudioSink) Play(format AudioFormat, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stream == nil || s.format != format {
+		if err := s.open(format); err != nil {
+			return err
+		}
+	}
+
+	s.playout.add(format, len(b))
+	// 端数はバッファに残し、次のチャンクと繋げて隙間なく書き込む
+	s.pending = append(s.pending, resampleLinear(pcmToSamples(b), format.Channels, format.SampleRate, s.deviceRate)...)
+	for len(s.pending) >= len(s.buf) {
+		copy(s.buf, s.pending)
+		s.pending = s.pending[len(s.buf):]
+		if err := s.stream.Write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PortAudioSink) Buffered() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.playout.buffered()
+}
+
+func (s *PortAudioSink) BeginUtterance() {}
+
+// EndUtterance writes out the partial buffer left by Play, padded with silence.
+func (s *PortAudioSink) EndUtterance() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream == nil || len(s.pending) == 0 {
+		return nil
+	}
+	n := copy(s.buf, s.pending)
+	for i := n; i < len(s.buf); i++ {
+		s.buf[i] = 0
+	}
+	s.pending = nil
+	return s.stream.Write()
+}
+
+// open starts an output stream at the clip's rate, falling back to the
+// device's default rate (and resampling) when the device rejects it.
+func (s *PortAudioSink) open(format AudioFormat) error {
+	s.closeStream()
+	s.pending = nil
+
+	s.buf = make([]int16, portAudioFramesPerBuffer*format.Channels)
+	rate := format.SampleRate
+	stream, err := s.audioSystem.OpenOutputStream(s.DeviceName, format.Channels, float64(rate), portAudioFramesPerBuffer, s.buf)
+	if err != nil {
+		defaultRate, rateErr := s.audioSystem.DefaultSampleRate(s.DeviceName)
+		if rateErr != nil || defaultRate == 0 || defaultRate == rate {
+			return err
+		}
+		log.Printf("Output device rejected %dHz (%v), resampling to %dHz", rate, err, defaultRate)
+		rate = defaultRate
+		stream, err = s.audioSystem.OpenOutputStream(s.DeviceName, format.Channels, float64(rate), portAudioFramesPerBuffer, s.buf)
+		if err != nil {
+			return err
+		}
+	}
+	if err := stream.Start(); err != nil {
+		stream.Close()
+		return err
+	}
+	s.stream = stream
+	s.format = format
+	s.deviceRate = rate
+	return nil
+}
+
+func (s *PortAudioSink) closeStream() {
+	if s.stream == nil {
+		return
+	}
+	s.stream.Stop()
+	s.stream.Close()
+	s.stream = nil
+}
+
+func (s *PortAudioSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeStream()
+	return s.audioSystem.Terminate()
+}
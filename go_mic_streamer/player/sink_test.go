@@ -0,0 +1,209 @@
+package player
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWAVFileSink(t *testing.T) {
+	t.Run("Should append utterances into one playable file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "replies.wav")
+		sink, err := NewWAVFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		format := AudioFormat{24000, 1}
+		first := bytes.Repeat([]byte{1, 0}, 2400)
+		second := bytes.Repeat([]byte{2, 0}, 4800)
+		sink.BeginUtterance()
+		if err := sink.Play(format, first); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.EndUtterance(); err != nil {
+			t.Fatal(err)
+		}
+		sink.BeginUtterance()
+		if err := sink.Play(format, second[:4800]); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Play(format, second[4800:]); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.EndUtterance(); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Play(AudioFormat{16000, 1}, first); err == nil {
+			t.Error("expected an error for a different format")
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := decodeWAV(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.format() != format || !bytes.Equal(c.pcm, append(first, second...)) {
+			t.Errorf("got %v with %d bytes", c.format(), len(c.pcm))
+		}
+
+		index, err := os.ReadFile(path + ".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(index)), "\n")
+		if len(lines) != 2 || !strings.Contains(lines[1], "offset=0.100s duration=0.200s") {
+			t.Errorf("got index %q", index)
+		}
+	})
+}
+
+func TestNewSink(t *testing.T) {
+	for _, spec := range []string{"oto", "pcm", "null"} {
+		if _, err := NewSink(spec, nil); err != nil {
+			t.Errorf("%s: unexpected error %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"wav", "portaudio", "speaker"} {
+		if _, err := NewSink(spec, nil); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+// fakeOutput is an output device that only takes its default rate.
+type fakeOutput struct {
+	rate    int
+	opened  []int
+	written [][]int16
+}
+
+type fakeOutputStream struct {
+	output *fakeOutput
+	buf    []int16
+}
+
+func (o *fakeOutput) Initialize() error { return nil }
+
+func (o *fakeOutput) Terminate() error { return nil }
+
+func (o *fakeOutput) DefaultSampleRate(deviceName string) (int, error) { return o.rate, nil }
+
+func (o *fakeOutput) OpenOutputStream(deviceName string, channels int, sampleRate float64, framesPerBuffer int, buf []int16) (OutputStream, error) {
+	o.opened = append(o.opened, int(sampleRate))
+	if int(sampleRate) != o.rate {
+		return nil, fmt.Errorf("invalid sample rate")
+	}
+	return &fakeOutputStream{output: o, buf: buf}, nil
+}
+
+func (s *fakeOutputStream) Start() error { return nil }
+
+func (s *fakeOutputStream) Stop() error { return nil }
+
+func (s *fakeOutputStream) Close() error { return nil }
+
+func (s *fakeOutputStream) Write() error {
+	s.output.written = append(s.output.written, append([]int16(nil), s.buf...))
+	return nil
+}
+
+func TestPortAudioSink(t *testing.T) {
+	t.Run("Should resample to the device rate when the device rejects the clip rate", func(t *testing.T) {
+		output := &fakeOutput{rate: 48000}
+		sink, err := NewPortAudioSink(output, "Handset")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 24kHz で 1024 フレーム、48kHz では 2048 フレーム
+		if err := sink.Play(AudioFormat{24000, 1}, make([]byte, 1024*2)); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := []int{24000, 48000}; !reflect.DeepEqual(output.opened, want) {
+			t.Errorf("opened at %v, want %v", output.opened, want)
+		}
+		if len(output.written) != 4 {
+			t.Errorf("got %d buffers written, want 4", len(output.written))
+		}
+	})
+
+	t.Run("Should pad the partial buffer with silence at the end of an utterance", func(t *testing.T) {
+		output := &fakeOutput{rate: 16000}
+		sink, err := NewPortAudioSink(output, "Handset")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := bytes.Repeat([]byte{1, 0}, portAudioFramesPerBuffer+10)
+		if err := sink.Play(AudioFormat{16000, 1}, b); err != nil {
+			t.Fatal(err)
+		}
+		if len(output.written) != 1 {
+			t.Fatalf("got %d buffers written before the end, want 1", len(output.written))
+		}
+		if err := sink.EndUtterance(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(output.written) != 2 {
+			t.Fatalf("got %d buffers written, want 2", len(output.written))
+		}
+		last := output.written[1]
+		if last[9] != 1 || last[10] != 0 || last[len(last)-1] != 0 {
+			t.Errorf("got last buffer starting %v", last[:12])
+		}
+	})
+}
+
+type stoppingSink struct {
+	player *Player
+	plays  int
+}
+
+func (s *stoppingSink) Play(format AudioFormat, b []byte) error {
+	s.plays++
+	s.player.Stop()
+	return nil
+}
+
+func (s *stoppingSink) Close() error { return nil }
+
+func TestPlayerStop(t *testing.T) {
+	t.Run("Should stop feeding the sink after Stop", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &stoppingSink{player: p}
+		p.Sink = sink
+		c := &clip{sampleRate: 24000, channels: 1, pcm: make([]byte, 24000*2)}
+
+		err := p.play(c, "", p.stoppedSince(p.stopGen.Load()))
+		if err != ErrStopped {
+			t.Errorf("got %v, want %v", err, ErrStopped)
+		}
+		// 停止前のチャンクとフェードアウトの 2 回
+		if sink.plays != 2 {
+			t.Errorf("got %d plays, want 2", sink.plays)
+		}
+	})
+
+	t.Run("Should not play a clip stopped before playback", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		sink := &stoppingSink{player: p}
+		p.Sink = sink
+		gen := p.stopGen.Load()
+		p.Stop()
+
+		err := p.play(&clip{sampleRate: 24000, channels: 1, pcm: make([]byte, 4800)}, "", p.stoppedSince(gen))
+		if err != ErrStopped || sink.plays != 0 {
+			t.Errorf("got %v after %d plays", err, sink.plays)
+		}
+	})
+}
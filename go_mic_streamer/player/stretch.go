@@ -0,0 +1,218 @@
+package player
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TimeStretcher changes the tempo of streamed PCM without changing its pitch
+// using WSOLA (waveform similarity overlap-add). Each output hop is the
+// cross-fade of the previous segment's tail with the input segment, near the
+// nominal analysis position, that best continues that tail. The rate can be
+// changed at any time and applies from the next hop.
+type TimeStretcher struct {
+	channels  int
+	hop       int
+	tolerance int
+	rate      float64
+	in        []float64
+	inPos     float64
+	prevStart int
+	tail      []float64
+	mu        sync.Mutex
+}
+
+const (
+	stretchHop       = 20 * time.Millisecond
+	stretchTolerance = 10 * time.Millisecond
+)
+
+func NewTimeStretcher(format AudioFormat) *TimeStretcher {
+	return &TimeStretcher{
+		channels:  format.Channels,
+		hop:       int(stretchHop.Seconds() * float64(format.SampleRate)),
+		tolerance: int(stretchTolerance.Seconds() * float64(format.SampleRate)),
+		rate:      1.0,
+		prevStart: -1,
+	}
+}
+
+// Playback speeds outside this range are clamped.
+const (
+	MinSpeechRate = 0.25
+	MaxSpeechRate = 4.0
+)
+
+// SetRate sets the playback speed; 0.8 is 20% slower, 1.25 is 25% faster.
+func (ts *TimeStretcher) SetRate(rate float64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.rate = clampRate(rate)
+}
+
+func clampRate(rate float64) float64 {
+	// NaN も最小値に寄せる
+	if !(rate >= MinSpeechRate) {
+		return MinSpeechRate
+	}
+	if rate > MaxSpeechRate {
+		return MaxSpeechRate
+	}
+	return rate
+}
+
+func (ts *TimeStretcher) Rate() float64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.rate
+}
+
+// Process consumes samples and returns whatever stretched output is ready.
+func (ts *TimeStretcher) Process(samples []int16) []int16 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, s := range samples {
+		ts.in = append(ts.in, float64(s))
+	}
+
+	var out []float64
+	for {
+		hop, ok := ts.nextHop()
+		if !ok {
+			break
+		}
+		out = append(out, hop...)
+	}
+	ts.compact()
+	return roundToInt16(out)
+}
+
+// Flush returns the remaining tail and resets the stretcher for the next utterance.
+func (ts *TimeStretcher) Flush() []int16 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	out := ts.tail
+	if ts.prevStart < 0 {
+		out = ts.in
+	} else {
+		// 最後のセグメント以降に読み残した入力もそのまま出す
+		rest := (ts.prevStart + 2*ts.hop) * ts.channels
+		if pos := int(ts.inPos) * ts.channels; pos > rest {
+			rest = pos
+		}
+		if rest < len(ts.in) {
+			out = append(out, ts.in[rest:]...)
+		}
+	}
+	ts.in = nil
+	ts.inPos = 0
+	ts.prevStart = -1
+	ts.tail = nil
+	return roundToInt16(out)
+}
+
+func (ts *TimeStretcher) frames() int {
+	return len(ts.in) / ts.channels
+}
+
+func (ts *TimeStretcher) segment(start int, length int) []float64 {
+	return ts.in[start*ts.channels : (start+length)*ts.channels]
+}
+
+func (ts *TimeStretcher) nextHop() ([]float64, bool) {
+	if ts.prevStart < 0 {
+		if ts.frames() < 2*ts.hop {
+			return nil, false
+		}
+		out := append([]float64{}, ts.segment(0, ts.hop)...)
+		ts.tail = append([]float64{}, ts.segment(ts.hop, ts.hop)...)
+		ts.prevStart = 0
+		ts.inPos = float64(ts.hop) * ts.rate
+		return out, true
+	}
+
+	nominal := int(ts.inPos)
+	if nominal+ts.tolerance+2*ts.hop > ts.frames() {
+		return nil, false
+	}
+
+	best := ts.bestOffset(nominal)
+	seg := ts.segment(best, 2*ts.hop)
+	out := make([]float64, ts.hop*ts.channels)
+	for i := 0; i < ts.hop; i++ {
+		w := float64(i) / float64(ts.hop)
+		for ch := 0; ch < ts.channels; ch++ {
+			j := i*ts.channels + ch
+			out[j] = ts.tail[j]*(1-w) + seg[j]*w
+		}
+	}
+	ts.tail = append(ts.tail[:0], seg[ts.hop*ts.channels:]...)
+	ts.prevStart = best
+	ts.inPos += float64(ts.hop) * ts.rate
+	return out, true
+}
+
+// bestOffset searches around nominal, closest candidates first, for the
+// segment whose start correlates best with the previous tail.
+func (ts *TimeStretcher) bestOffset(nominal int) int {
+	best := nominal
+	bestScore := ts.correlation(nominal)
+	for d := 1; d <= ts.tolerance; d++ {
+		for _, c := range []int{nominal - d, nominal + d} {
+			if c < 0 {
+				continue
+			}
+			if score := ts.correlation(c); score > bestScore+1e-9 {
+				best = c
+				bestScore = score
+			}
+		}
+	}
+	return best
+}
+
+func (ts *TimeStretcher) correlation(start int) float64 {
+	seg := ts.segment(start, ts.hop)
+	var dot, energy float64
+	for i, v := range seg {
+		dot += v * ts.tail[i]
+		energy += v * v
+	}
+	if energy == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(energy)
+}
+
+// compact drops input that no future hop can reach.
+func (ts *TimeStretcher) compact() {
+	if ts.prevStart < 0 {
+		return
+	}
+	drop := int(ts.inPos) - ts.tolerance
+	if drop > ts.prevStart {
+		drop = ts.prevStart
+	}
+	if drop <= 0 {
+		return
+	}
+	ts.in = append(ts.in[:0], ts.in[drop*ts.channels:]...)
+	ts.inPos -= float64(drop)
+	ts.prevStart -= drop
+}
+
+func roundToInt16(x []float64) []int16 {
+	samples := make([]int16, len(x))
+	for i, v := range x {
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		samples[i] = int16(math.Round(v))
+	}
+	return samples
+}
@@ -0,0 +1,94 @@
+package player
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func stretchAll(ts *TimeStretcher, samples []int16, chunk int) []int16 {
+	var out []int16
+	for len(samples) > 0 {
+		n := chunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+		out = append(out, ts.Process(samples[:n])...)
+		samples = samples[n:]
+	}
+	return append(out, ts.Flush()...)
+}
+
+// zeroCrossingRate estimates the frequency of a mono sine from its zero crossings.
+func zeroCrossingRate(samples []int16, rate int) float64 {
+	crossings := 0
+	for i := 1; i < len(samples); i++ {
+		if (samples[i-1] < 0) != (samples[i] < 0) {
+			crossings++
+		}
+	}
+	return float64(crossings) / 2 / (float64(len(samples)) / float64(rate))
+}
+
+func TestTimeStretcher(t *testing.T) {
+	rate := 24000
+	input := sine(220, 0.5, rate, 2*time.Second)
+
+	t.Run("Should pass audio through unchanged at rate 1.0", func(t *testing.T) {
+		ts := NewTimeStretcher(AudioFormat{rate, 1})
+
+		got := stretchAll(ts, input, 1000)
+
+		if len(got) != len(input) {
+			t.Fatalf("got %d samples, want %d", len(got), len(input))
+		}
+		for i := range got {
+			if d := int(got[i]) - int(input[i]); d > 1 || d < -1 {
+				t.Fatalf("sample %d: got %d, want %d", i, got[i], input[i])
+			}
+		}
+	})
+
+	for _, speed := range []float64{0.75, 1.5} {
+		t.Run(fmt.Sprintf("Should change duration but not pitch at rate %v", speed), func(t *testing.T) {
+			ts := NewTimeStretcher(AudioFormat{rate, 1})
+			ts.SetRate(speed)
+
+			got := stretchAll(ts, input, 1000)
+
+			wantLen := float64(len(input)) / speed
+			if math.Abs(float64(len(got))-wantLen)/wantLen > 0.05 {
+				t.Errorf("rate %v: got %d samples, want about %.0f", speed, len(got), wantLen)
+			}
+			if f := zeroCrossingRate(got, rate); math.Abs(f-220) > 5 {
+				t.Errorf("rate %v: got %.1f Hz, want 220 Hz", speed, f)
+			}
+		})
+	}
+
+	t.Run("Should apply a rate change mid-stream", func(t *testing.T) {
+		ts := NewTimeStretcher(AudioFormat{rate, 1})
+		half := len(input) / 2
+
+		first := ts.Process(input[:half])
+		ts.SetRate(2.0)
+		second := append(ts.Process(input[half:]), ts.Flush()...)
+
+		if len(second) > len(first)*2/3 {
+			t.Errorf("got %d samples after speeding up, %d before", len(second), len(first))
+		}
+	})
+}
+
+func TestSetSpeechRate(t *testing.T) {
+	t.Run("Should clamp the rate", func(t *testing.T) {
+		p := NewPlayer(nil, "")
+		for _, c := range []struct{ rate, want float64 }{{0, MinSpeechRate}, {-1, MinSpeechRate}, {math.NaN(), MinSpeechRate}, {10, MaxSpeechRate}, {1.5, 1.5}} {
+			p.SetSpeechRate(c.rate)
+			if got := p.SpeechRate(); got != c.want {
+				t.Errorf("rate %v: got %v, want %v", c.rate, got, c.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package player
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubtitleWriter appends one cue per utterance to an SRT and a WebVTT file.
+// Cue times are relative to the session start so they line up with the
+// session recording. The WebVTT cues carry word timestamps for live captions.
+type SubtitleWriter struct {
+	srt          *os.File
+	vtt          *os.File
+	sessionStart time.Time
+	count        int
+	mu           sync.Mutex
+}
+
+func NewSubtitleWriter(basePath string, sessionStart time.Time) (*SubtitleWriter, error) {
+	srt, err := os.Create(basePath + ".srt")
+	if err != nil {
+		return nil, err
+	}
+	vtt, err := os.Create(basePath + ".vtt")
+	if err != nil {
+		srt.Close()
+		return nil, err
+	}
+	if _, err := vtt.WriteString("WEBVTT\n\n"); err != nil {
+		srt.Close()
+		vtt.Close()
+		return nil, err
+	}
+	return &SubtitleWriter{srt: srt, vtt: vtt, sessionStart: sessionStart}, nil
+}
+
+func (sw *SubtitleWriter) Add(text string, start time.Time, duration time.Duration, words []TimingEvent) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.count++
+	offset := start.Sub(sw.sessionStart)
+	end := offset + duration
+	if _, err := sw.srt.WriteString(formatSRTCue(sw.count, offset, end, text)); err != nil {
+		return err
+	}
+	_, err := sw.vtt.WriteString(formatVTTCue(offset, end, text, words))
+	return err
+}
+
+func (sw *SubtitleWriter) Close() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	srtErr := sw.srt.Close()
+	if err := sw.vtt.Close(); err != nil {
+		return err
+	}
+	return srtErr
+}
+
+func formatSRTCue(index int, start time.Duration, end time.Duration, text string) string {
+	return fmt.Sprintf("%d\n%s --> %s\n%s\n\n", index, formatTimestamp(start, ","), formatTimestamp(end, ","), text)
+}
+
+// formatVTTCue writes the utterance text followed by a karaoke style line of
+// words, each prefixed with its timestamp tag.
+func formatVTTCue(start time.Duration, end time.Duration, text string, words []TimingEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s --> %s\n%s\n", formatTimestamp(start, "."), formatTimestamp(end, "."), text)
+	if len(words) > 0 {
+		for _, w := range words {
+			fmt.Fprintf(&b, "<%s>%s", formatTimestamp(start+w.Start, "."), w.Text)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func formatTimestamp(d time.Duration, sep string) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
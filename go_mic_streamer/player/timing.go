@@ -0,0 +1,99 @@
+package player
+
+import (
+	"time"
+)
+
+type TimingKind string
+
+const (
+	TimingMora TimingKind = "mora"
+	TimingWord TimingKind = "word"
+)
+
+// TimingEvent marks when a mora or a word (accent phrase) is heard, relative
+// to the start of the utterance.
+type TimingEvent struct {
+	Kind  TimingKind
+	Text  string
+	Start time.Duration
+	End   time.Duration
+}
+
+// computeTiming derives mora and word timestamps from an audio query the same
+// way the engine lays them out: pre-phoneme silence, consonant and vowel
+// lengths (plus pause moras) and post-phoneme silence, all divided by speedScale.
+func computeTiming(params *Params) ([]TimingEvent, time.Duration) {
+	speed := params.SpeedScale
+	if speed <= 0 {
+		speed = 1.0
+	}
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s / speed * float64(time.Second))
+	}
+
+	var events []TimingEvent
+	t := seconds(params.PrePhonemeLength)
+	for _, phrase := range params.AccentPhrases {
+		wordIndex := len(events)
+		word := TimingEvent{Kind: TimingWord, Start: t}
+		events = append(events, word)
+		for _, mora := range phrase.Moras {
+			length := mora.VowelLength
+			if mora.ConsonantLength != nil {
+				length += *mora.ConsonantLength
+			}
+			end := t + seconds(length)
+			events = append(events, TimingEvent{TimingMora, mora.Text, t, end})
+			word.Text += mora.Text
+			t = end
+		}
+		word.End = t
+		events[wordIndex] = word
+		if phrase.PauseMora != nil {
+			t += seconds(phrase.PauseMora.VowelLength)
+		}
+	}
+	return events, t + seconds(params.PostPhonemeLength)
+}
+
+// scaleTiming adjusts the event times of c for playback at rate.
+func scaleTiming(c *clip, rate float64) []TimingEvent {
+	if rate == 1.0 || rate <= 0 {
+		return c.timing
+	}
+	out := make([]TimingEvent, len(c.timing))
+	for i, ev := range c.timing {
+		ev.Start = c.playbackTime(ev.Start, rate)
+		ev.End = c.playbackTime(ev.End, rate)
+		out[i] = ev
+	}
+	return out
+}
+
+// words returns only the word events of events.
+func words(events []TimingEvent) []TimingEvent {
+	var out []TimingEvent
+	for _, ev := range events {
+		if ev.Kind == TimingWord {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// emitTiming calls fn for each event when its start time is reached after
+// start, until done is closed.
+func emitTiming(events []TimingEvent, start time.Time, fn func(TimingEvent), done <-chan struct{}) {
+	for _, ev := range events {
+		wait := time.Until(start.Add(ev.Start))
+		if wait > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(wait):
+			}
+		}
+		fn(ev)
+	}
+}
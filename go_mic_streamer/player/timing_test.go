@@ -0,0 +1,70 @@
+package player
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeTiming(t *testing.T) {
+	k := "k"
+	consonant := 0.05
+
+	t.Run("Should lay out moras and words scaled by speed", func(t *testing.T) {
+		params := &Params{
+			SpeedScale:        2.0,
+			PrePhonemeLength:  0.1,
+			PostPhonemeLength: 0.1,
+			AccentPhrases: []AccentPhrases{
+				{
+					Moras: []Mora{
+						{Text: "カ", Consonant: &k, ConsonantLength: &consonant, Vowel: "a", VowelLength: 0.15},
+						{Text: "ア", Vowel: "a", VowelLength: 0.2},
+					},
+					PauseMora: &Mora{Text: "、", Vowel: "pau", VowelLength: 0.4},
+				},
+				{
+					Moras: []Mora{{Text: "イ", Vowel: "i", VowelLength: 0.1}},
+				},
+			},
+		}
+
+		got, total := computeTiming(params)
+		ms := time.Millisecond
+		want := []TimingEvent{
+			{TimingWord, "カア", 50 * ms, 250 * ms},
+			{TimingMora, "カ", 50 * ms, 150 * ms},
+			{TimingMora, "ア", 150 * ms, 250 * ms},
+			{TimingWord, "イ", 450 * ms, 500 * ms},
+			{TimingMora, "イ", 450 * ms, 500 * ms},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if total != 550*ms {
+			t.Errorf("got total %v, want %v", total, 550*ms)
+		}
+	})
+}
+
+func TestFormatCues(t *testing.T) {
+	t.Run("Should format an SRT cue", func(t *testing.T) {
+		got := formatSRTCue(3, 61*time.Second+5*time.Millisecond, 3723*time.Second, "はい")
+		want := "3\n00:01:01,005 --> 01:02:03,000\nはい\n\n"
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Should add word timestamps to a WebVTT cue", func(t *testing.T) {
+		words := []TimingEvent{
+			{TimingWord, "ハイ", 100 * time.Millisecond, 300 * time.Millisecond},
+			{TimingWord, "ソウデス", 300 * time.Millisecond, 800 * time.Millisecond},
+		}
+		got := formatVTTCue(time.Second, 2*time.Second, "はい、そうです", words)
+		want := "00:00:01.000 --> 00:00:02.000\nはい、そうです\n<00:00:01.100>ハイ<00:00:01.300>ソウデス\n\n"
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
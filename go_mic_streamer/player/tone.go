@@ -0,0 +1,117 @@
+package player
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// ToneStep is a burst of one or more mixed frequencies followed by a gap.
+type ToneStep struct {
+	Freqs []float64
+	On    time.Duration
+	Off   time.Duration
+	// AM is the frequency of a full amplitude modulation of the burst, as
+	// used by the Japanese ring-back tone. Zero means none.
+	AM float64
+}
+
+// Tone is a sequence of tone bursts such as DTMF digits or a call-progress
+// signal. Level is the level of each frequency in dBFS.
+type Tone struct {
+	Steps []ToneStep
+	Level float64
+}
+
+const (
+	dtmfToneOn  = 100 * time.Millisecond
+	dtmfToneOff = 100 * time.Millisecond
+	toneLevel   = -12.0
+	// バーストの立ち上がりと立ち下がり。クリック音を防ぐ
+	toneEdge = 5 * time.Millisecond
+)
+
+var dtmfFreqs = map[rune][2]float64{
+	'1': {697, 1209}, '2': {697, 1336}, '3': {697, 1477}, 'A': {697, 1633},
+	'4': {770, 1209}, '5': {770, 1336}, '6': {770, 1477}, 'B': {770, 1633},
+	'7': {852, 1209}, '8': {852, 1336}, '9': {852, 1477}, 'C': {852, 1633},
+	'*': {941, 1209}, '0': {941, 1336}, '#': {941, 1477}, 'D': {941, 1633},
+}
+
+// Call-progress tones as heard on Japanese lines.
+var (
+	RingbackTone = Tone{Steps: []ToneStep{{Freqs: []float64{400}, AM: 16, On: time.Second, Off: 2 * time.Second}}, Level: toneLevel}
+	BusyTone     = Tone{Steps: []ToneStep{{Freqs: []float64{400}, On: 500 * time.Millisecond, Off: 500 * time.Millisecond}}, Level: toneLevel}
+	BeepTone     = Tone{Steps: []ToneStep{{Freqs: []float64{1000}, On: 150 * time.Millisecond}}, Level: toneLevel}
+)
+
+// DTMFTone returns the tone for digits, each 100ms on and 100ms off.
+func DTMFTone(digits string) (Tone, error) {
+	t := Tone{Level: toneLevel}
+	for _, d := range strings.ToUpper(digits) {
+		freqs, ok := dtmfFreqs[d]
+		if !ok {
+			return Tone{}, fmt.Errorf("invalid DTMF digit %q", d)
+		}
+		t.Steps = append(t.Steps, ToneStep{Freqs: freqs[:], On: dtmfToneOn, Off: dtmfToneOff})
+	}
+	if len(t.Steps) == 0 {
+		return Tone{}, fmt.Errorf("no DTMF digits")
+	}
+	return t, nil
+}
+
+// ToneByName returns "ringback", "busy" or "beep".
+func ToneByName(name string) (Tone, error) {
+	switch name {
+	case "ringback":
+		return RingbackTone, nil
+	case "busy":
+		return BusyTone, nil
+	case "beep":
+		return BeepTone, nil
+	}
+	return Tone{}, fmt.Errorf("unknown tone %q", name)
+}
+
+// PlayTone plays t through the same path as speech; Stop interrupts it.
+func (p *Player) PlayTone(t Tone) error {
+	gen := p.stopGen.Load()
+	return p.output(t.render(AudioFormat{SampleRate: 24000, Channels: 1}), p.stoppedSince(gen))
+}
+
+func (t Tone) render(format AudioFormat) *clip {
+	rate := float64(format.SampleRate)
+	gain := dbToGain(t.Level)
+	edge := int(toneEdge.Seconds() * rate)
+
+	var x []float64
+	for _, step := range t.Steps {
+		on := int(step.On.Seconds() * rate)
+		for i := 0; i < on; i++ {
+			env := 1.0
+			if k := i; k < edge {
+				env = 0.5 - 0.5*math.Cos(math.Pi*float64(k)/float64(edge))
+			} else if k := on - 1 - i; k < edge {
+				env = 0.5 - 0.5*math.Cos(math.Pi*float64(k)/float64(edge))
+			}
+			if step.AM > 0 {
+				env *= 0.5 - 0.5*math.Cos(2*math.Pi*step.AM*float64(i)/rate)
+			}
+			var v float64
+			for _, f := range step.Freqs {
+				v += math.Sin(2 * math.Pi * f * float64(i) / rate)
+			}
+			v *= gain * env
+			for ch := 0; ch < format.Channels; ch++ {
+				x = append(x, v)
+			}
+		}
+		off := int(step.Off.Seconds() * rate)
+		x = append(x, make([]float64, off*format.Channels)...)
+	}
+	c := &clip{sampleRate: format.SampleRate, channels: format.Channels, pcm: samplesToPCM(fromFloat(x))}
+	c.raw = []frameRange{{0, c.frames()}}
+	return c
+}
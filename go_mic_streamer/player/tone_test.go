@@ -0,0 +1,119 @@
+package player
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	pcm "github.com/killinsun/voice-conversation-ai/go_mic_streamer/recorder"
+)
+
+func TestDTMFTone(t *testing.T) {
+	t.Run("Should be recognized by the DTMF detector", func(t *testing.T) {
+		tone, err := DTMFTone("90#*a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := tone.render(AudioFormat{SampleRate: 16000, Channels: 1})
+
+		var got []string
+		for _, ev := range pcm.NewDTMFDetector(16000).Process(pcmToSamples(c.pcm), c.duration()) {
+			got = append(got, ev.Digit)
+		}
+
+		if want := []string{"9", "0", "#", "*", "A"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := c.duration(), 5*(dtmfToneOn+dtmfToneOff); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Should reject digits that are not on the keypad", func(t *testing.T) {
+		for _, digits := range []string{"", "12E", "0-1"} {
+			if _, err := DTMFTone(digits); err == nil {
+				t.Errorf("%q: expected an error", digits)
+			}
+		}
+	})
+}
+
+func TestToneRender(t *testing.T) {
+	t.Run("Should start and end each burst softly", func(t *testing.T) {
+		c := BusyTone.render(AudioFormat{SampleRate: 8000, Channels: 2})
+		samples := pcmToSamples(c.pcm)
+
+		if got := c.duration(); got != time.Second {
+			t.Errorf("got %v, want 1s", got)
+		}
+		if samples[0] != 0 || samples[1] != 0 {
+			t.Errorf("first frame %v, want silence", samples[:2])
+		}
+		// 無音の区間が続く
+		for _, s := range samples[len(samples)/2+2:] {
+			if s != 0 {
+				t.Fatalf("got %d in the gap, want silence", s)
+			}
+		}
+		peak := 0.0
+		for _, s := range samples {
+			peak = math.Max(peak, math.Abs(float64(s)))
+		}
+		if want := dbToGain(toneLevel) * 32768; math.Abs(peak-want) > want*0.01 {
+			t.Errorf("got peak %v, want %v", peak, want)
+		}
+	})
+}
+
+func TestPlayTone(t *testing.T) {
+	format := AudioFormat{SampleRate: 24000, Channels: 1}
+	speech := &clip{sampleRate: 24000, channels: 1, pcm: samplesToPCM(sine(440, 0.05, 24000, time.Second))}
+	tone := BusyTone.render(format)
+
+	t.Run("Should leave a tone out of mastering", func(t *testing.T) {
+		c, err := speech.concat(tone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := DefaultMastering().apply(c)
+
+		if len(got.raw) != 1 {
+			t.Fatalf("got %d raw ranges, want 1", len(got.raw))
+		}
+		r := got.raw[0]
+		gotTone := pcmToSamples(got.pcm)[r.start:r.end]
+		if want := pcmToSamples(tone.pcm)[:len(gotTone)]; !reflect.DeepEqual(gotTone, want) {
+			t.Error("the tone was changed by mastering")
+		}
+	})
+
+	t.Run("Should not stretch a tone", func(t *testing.T) {
+		c, err := speech.concat(tone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewPlayer(nil, "")
+		sink := &countingSink{}
+		p.Sink = sink
+		p.SetSpeechRate(2.0)
+		var calls []bool
+		p.OnTone = func(playing bool) { calls = append(calls, playing) }
+
+		if err := p.output(c, p.stoppedSince(p.stopGen.Load())); err != nil {
+			t.Fatal(err)
+		}
+
+		want := len(speech.pcm)/2 + len(tone.pcm)
+		if got := sink.played(); got < want-4800 || got > want+4800 {
+			t.Errorf("got %d bytes, want about %d", got, want)
+		}
+		if !reflect.DeepEqual(calls, []bool{true, false}) {
+			t.Errorf("got OnTone calls %v, want [true false]", calls)
+		}
+		if got, want := c.playbackTime(c.duration(), 2.0), 500*time.Millisecond+tone.duration(); got != want {
+			t.Errorf("got playback time %v, want %v", got, want)
+		}
+	})
+}
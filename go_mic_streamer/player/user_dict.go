@@ -0,0 +1,301 @@
+package player
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LexiconEntry is one word of the local user dictionary.
+type LexiconEntry struct {
+	Surface       string
+	Pronunciation string
+	AccentType    int
+	Priority      int
+}
+
+// UserDictWord is a word registered on the engine as returned by GET /user_dict.
+type UserDictWord struct {
+	Surface       string `json:"surface"`
+	Pronunciation string `json:"pronunciation"`
+	AccentType    int    `json:"accent_type"`
+	Priority      int    `json:"priority"`
+}
+
+type DictChangeKind string
+
+const (
+	DictAdd    DictChangeKind = "add"
+	DictUpdate DictChangeKind = "update"
+	DictDelete DictChangeKind = "delete"
+)
+
+type DictChange struct {
+	Kind  DictChangeKind
+	UUID  string
+	Entry LexiconEntry
+	Old   UserDictWord
+}
+
+func (c DictChange) String() string {
+	switch c.Kind {
+	case DictAdd:
+		return fmt.Sprintf("+ %s %s accent=%d priority=%d", c.Entry.Surface, c.Entry.Pronunciation, c.Entry.AccentType, c.Entry.Priority)
+	case DictUpdate:
+		return fmt.Sprintf("~ %s %s accent=%d priority=%d (was %s accent=%d priority=%d)", c.Entry.Surface, c.Entry.Pronunciation, c.Entry.AccentType, c.Entry.Priority, c.Old.Pronunciation, c.Old.AccentType, c.Old.Priority)
+	default:
+		return fmt.Sprintf("- %s %s", c.Old.Surface, c.Old.Pronunciation)
+	}
+}
+
+const defaultDictPriority = 5
+
+// LoadLexicon reads a lexicon from a CSV (.csv) or YAML (.yaml/.yml) file.
+//
+// CSV files need a header row with surface, pronunciation, accent_type and an
+// optional priority column. YAML files are a flat list of mappings with the
+// same keys, one "- surface: 首無商事" item per word.
+func LoadLexicon(path string) ([]LexiconEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return parseLexiconCSV(f)
+	case ".yaml", ".yml":
+		return parseLexiconYAML(f)
+	}
+	return nil, fmt.Errorf("unsupported lexicon format: %s", path)
+}
+
+func parseLexiconCSV(r io.Reader) ([]LexiconEntry, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"surface", "pronunciation", "accent_type"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("lexicon csv: missing %q column", required)
+		}
+	}
+
+	var entries []LexiconEntry
+	for line, record := range records[1:] {
+		fields := map[string]string{}
+		for name, i := range columns {
+			if i < len(record) {
+				fields[name] = record[i]
+			}
+		}
+		entry, err := lexiconEntryFromFields(fields)
+		if err != nil {
+			return nil, fmt.Errorf("lexicon csv line %d: %w", line+2, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseLexiconYAML understands only the flat list-of-mappings layout shown in LoadLexicon.
+func parseLexiconYAML(r io.Reader) ([]LexiconEntry, error) {
+	var entries []LexiconEntry
+	var fields map[string]string
+	flush := func(line int) error {
+		if fields == nil {
+			return nil
+		}
+		entry, err := lexiconEntryFromFields(fields)
+		if err != nil {
+			return fmt.Errorf("lexicon yaml entry ending at line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+		fields = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "- ") || text == "-" {
+			if err := flush(line - 1); err != nil {
+				return nil, err
+			}
+			fields = map[string]string{}
+			text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+			if text == "" {
+				continue
+			}
+		}
+		if fields == nil {
+			return nil, fmt.Errorf("lexicon yaml line %d: expected a list item", line)
+		}
+		key, value, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("lexicon yaml line %d: expected key: value", line)
+		}
+		fields[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(line); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func lexiconEntryFromFields(fields map[string]string) (LexiconEntry, error) {
+	entry := LexiconEntry{
+		Surface:       strings.TrimSpace(fields["surface"]),
+		Pronunciation: strings.TrimSpace(fields["pronunciation"]),
+		Priority:      defaultDictPriority,
+	}
+	if entry.Surface == "" || entry.Pronunciation == "" {
+		return entry, fmt.Errorf("surface and pronunciation are required")
+	}
+	accent, err := strconv.Atoi(strings.TrimSpace(fields["accent_type"]))
+	if err != nil {
+		return entry, fmt.Errorf("invalid accent_type %q", fields["accent_type"])
+	}
+	entry.AccentType = accent
+	if p := strings.TrimSpace(fields["priority"]); p != "" {
+		priority, err := strconv.Atoi(p)
+		if err != nil || priority < 0 || priority > 10 {
+			return entry, fmt.Errorf("invalid priority %q", p)
+		}
+		entry.Priority = priority
+	}
+	return entry, nil
+}
+
+// DiffUserDict compares the lexicon with the words registered on the engine.
+// Words only on the engine are reported as deletions when prune is set.
+func DiffUserDict(lexicon []LexiconEntry, current map[string]UserDictWord, prune bool) []DictChange {
+	bySurface := map[string]string{}
+	for uuid, word := range current {
+		bySurface[normalizeSurface(word.Surface)] = uuid
+	}
+
+	var changes []DictChange
+	seen := map[string]bool{}
+	for _, entry := range lexicon {
+		uuid, ok := bySurface[normalizeSurface(entry.Surface)]
+		if !ok {
+			changes = append(changes, DictChange{Kind: DictAdd, Entry: entry})
+			continue
+		}
+		seen[uuid] = true
+		old := current[uuid]
+		if old.Pronunciation != entry.Pronunciation || old.AccentType != entry.AccentType || old.Priority != entry.Priority {
+			changes = append(changes, DictChange{Kind: DictUpdate, UUID: uuid, Entry: entry, Old: old})
+		}
+	}
+
+	if prune {
+		var uuids []string
+		for uuid := range current {
+			if !seen[uuid] {
+				uuids = append(uuids, uuid)
+			}
+		}
+		sort.Strings(uuids)
+		for _, uuid := range uuids {
+			changes = append(changes, DictChange{Kind: DictDelete, UUID: uuid, Old: current[uuid]})
+		}
+	}
+	return changes
+}
+
+// normalizeSurface converts ASCII to full width, as the engine stores surfaces that way.
+func normalizeSurface(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r > 0x20 && r < 0x7f {
+			return r + 0xfee0
+		}
+		return r
+	}, s)
+}
+
+// SyncUserDict applies the lexicon to every engine of vc. With dryRun the
+// changes are only computed.
+func SyncUserDict(ctx context.Context, vc *VoicevoxClient, lexicon []LexiconEntry, prune bool, dryRun bool) (map[string][]DictChange, error) {
+	result := map[string][]DictChange{}
+	for _, e := range vc.pool.engines {
+		current, err := vc.userDict(ctx, e)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", e.endpoint, err)
+		}
+		changes := DiffUserDict(lexicon, current, prune)
+		result[e.endpoint] = changes
+		if dryRun {
+			continue
+		}
+		for _, c := range changes {
+			if err := vc.applyDictChange(ctx, e, c); err != nil {
+				return result, fmt.Errorf("%s: %s: %w", e.endpoint, c, err)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (vc *VoicevoxClient) userDict(ctx context.Context, e *engine) (map[string]UserDictWord, error) {
+	b, err := vc.doOnce(ctx, e, "GET", "/user_dict", nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	words := map[string]UserDictWord{}
+	if err := json.Unmarshal(b, &words); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
+
+func (vc *VoicevoxClient) applyDictChange(ctx context.Context, e *engine, c DictChange) error {
+	q := url.Values{}
+	q.Add("surface", c.Entry.Surface)
+	q.Add("pronunciation", c.Entry.Pronunciation)
+	q.Add("accent_type", strconv.Itoa(c.Entry.AccentType))
+	q.Add("priority", strconv.Itoa(c.Entry.Priority))
+
+	var err error
+	switch c.Kind {
+	case DictAdd:
+		q.Add("word_type", "PROPER_NOUN")
+		_, err = vc.doOnce(ctx, e, "POST", "/user_dict_word", q, nil, "")
+	case DictUpdate:
+		q.Add("word_type", "PROPER_NOUN")
+		_, err = vc.doOnce(ctx, e, "PUT", "/user_dict_word/"+url.PathEscape(c.UUID), q, nil, "")
+	case DictDelete:
+		_, err = vc.doOnce(ctx, e, "DELETE", "/user_dict_word/"+url.PathEscape(c.UUID), nil, nil, "")
+	}
+	return err
+}
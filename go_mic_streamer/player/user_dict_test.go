@@ -0,0 +1,78 @@
+package player
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLexicon(t *testing.T) {
+	want := []LexiconEntry{
+		{"首無商事", "クビナシショウジ", 4, 7},
+		{"VOICEVOX", "ボイスボックス", 4, 5},
+	}
+
+	t.Run("Should parse csv with header", func(t *testing.T) {
+		input := "surface,pronunciation,accent_type,priority\n首無商事,クビナシショウジ,4,7\nVOICEVOX,ボイスボックス,4,\n"
+
+		got, err := parseLexiconCSV(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Should parse yaml list", func(t *testing.T) {
+		input := "# lexicon\n- surface: 首無商事\n  pronunciation: クビナシショウジ\n  accent_type: 4\n  priority: 7\n-\n  surface: \"VOICEVOX\"\n  pronunciation: ボイスボックス\n  accent_type: 4\n"
+
+		got, err := parseLexiconYAML(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Should reject entries without accent type", func(t *testing.T) {
+		input := "surface,pronunciation,accent_type\n首無商事,クビナシショウジ,\n"
+
+		if _, err := parseLexiconCSV(strings.NewReader(input)); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestDiffUserDict(t *testing.T) {
+	lexicon := []LexiconEntry{
+		{"首無商事", "クビナシショウジ", 4, 7},
+		{"VOICEVOX", "ボイスボックス", 4, 5},
+		{"新語", "シンゴ", 0, 5},
+	}
+	current := map[string]UserDictWord{
+		"uuid-1": {"首無商事", "クビナシショウジ", 4, 7},
+		"uuid-2": {"ＶＯＩＣＥＶＯＸ", "ボイスボックス", 1, 5},
+		"uuid-3": {"古語", "コゴ", 1, 5},
+	}
+
+	t.Run("Should report adds and updates and skip unchanged words", func(t *testing.T) {
+		got := DiffUserDict(lexicon, current, false)
+		want := []DictChange{
+			{Kind: DictUpdate, UUID: "uuid-2", Entry: lexicon[1], Old: current["uuid-2"]},
+			{Kind: DictAdd, Entry: lexicon[2]},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Should delete unknown words when pruning", func(t *testing.T) {
+		got := DiffUserDict(lexicon, current, true)
+		last := got[len(got)-1]
+		if len(got) != 3 || last.Kind != DictDelete || last.UUID != "uuid-3" {
+			t.Errorf("got %v", got)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package player
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// StatusError is returned when the VOICEVOX engine answers with a non-2xx status.
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("voicevox: %s %s returned %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// VoicevoxClient talks to one or more VOICEVOX engines with per-request
+// timeouts, retries with exponential backoff and a circuit breaker per engine.
+// Requests go to the healthy engine with the fewest outstanding requests.
+type VoicevoxClient struct {
+	Endpoints    []string
+	Timeout      time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	httpClient   *http.Client
+	pool         *enginePool
+}
+
+// NewVoicevoxClient trims the endpoints and skips empty ones, so a flag like
+// "http://a:50021, http://b:50021/" can be passed as it is split.
+func NewVoicevoxClient(endpoints []string, timeout time.Duration, maxRetries int) *VoicevoxClient {
+	pool := newEnginePool(endpoints)
+	var vc = &VoicevoxClient{
+		Endpoints:    pool.endpoints(),
+		Timeout:      timeout,
+		MaxRetries:   maxRetries,
+		RetryBackoff: 200 * time.Millisecond,
+		MaxBackoff:   2 * time.Second,
+		httpClient:   &http.Client{},
+		pool:         pool,
+	}
+	return vc
+}
+
+// StartHealthChecks polls GET /version on every engine until ctx is done.
+// Engines failing the check are skipped until they answer again.
+func (vc *VoicevoxClient) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, e := range vc.pool.engines {
+				vc.checkHealth(ctx, e)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (vc *VoicevoxClient) checkHealth(ctx context.Context, e *engine) {
+	_, err := vc.doOnce(ctx, e, "GET", "/version", nil, nil, "")
+	healthy := err == nil
+	if healthy != e.isHealthy() {
+		log.Printf("voicevox: engine %s healthy=%v (%v)", e.endpoint, healthy, err)
+	}
+	e.setHealthy(healthy)
+}
+
+func (vc *VoicevoxClient) Speakers(ctx context.Context) (Speakers, error) {
+	b, err := vc.do(ctx, "GET", "/speakers", nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var speakers Speakers
+	if err := json.Unmarshal(b, &speakers); err != nil {
+		return nil, err
+	}
+	return speakers, nil
+}
+
+func (vc *VoicevoxClient) AudioQuery(ctx context.Context, speakerID int, text string) (*Params, error) {
+	q := url.Values{}
+	q.Add("speaker", strconv.Itoa(speakerID))
+	q.Add("text", text)
+	b, err := vc.do(ctx, "POST", "/audio_query", q, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var params *Params
+	if err := json.Unmarshal(b, &params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (vc *VoicevoxClient) Synthesis(ctx context.Context, speakerID int, params *Params) ([]byte, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Add("speaker", strconv.Itoa(speakerID))
+	return vc.do(ctx, "POST", "/synthesis", q, body, "audio/wav")
+}
+
+// do sends a request, retrying transient failures (network errors, timeouts,
+// 429 and 5xx) on the next selected engine until MaxRetries is exhausted or
+// every engine's circuit is open. A call counts as one failure for each engine
+// that failed it, however often it was retried there.
+func (vc *VoicevoxClient) do(ctx context.Context, method string, path string, query url.Values, body []byte, accept string) ([]byte, error) {
+	var lastErr error
+	failed := map[*engine]bool{}
+	for attempt := 0; attempt <= vc.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := vc.backoff(attempt)
+			log.Printf("voicevox: retrying %s %s in %v (attempt %d): %v", method, path, wait, attempt, lastErr)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		e, err := vc.pool.acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := vc.doOnce(ctx, e, method, path, query, body, accept)
+		vc.pool.release(e)
+		if err == nil {
+			e.breaker.success()
+			return b, nil
+		}
+		lastErr = err
+
+		if !isRetryable(err) || ctx.Err() != nil {
+			// 4xx はエンジン側の障害ではないのでブレーカーには数えない
+			e.breaker.release()
+			break
+		}
+		if !failed[e] {
+			failed[e] = true
+			e.breaker.failure()
+		}
+	}
+	return nil, lastErr
+}
+
+func (vc *VoicevoxClient) doOnce(ctx context.Context, e *engine, method string, path string, query url.Values, body []byte, accept string) ([]byte, error) {
+	if vc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vc.Timeout)
+		defer cancel()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, e.endpoint+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
+	}
+	if accept != "" {
+		req.Header.Add("Accept", accept)
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := vc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buff := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buff, resp.Body); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := buff.String()
+		if len(msg) > 256 {
+			msg = msg[:256]
+		}
+		return nil, &StatusError{method, path, resp.StatusCode, msg}
+	}
+	return buff.Bytes(), nil
+}
+
+func (vc *VoicevoxClient) backoff(attempt int) time.Duration {
+	d := vc.RetryBackoff << uint(attempt-1)
+	if d > vc.MaxBackoff || d <= 0 {
+		d = vc.MaxBackoff
+	}
+	// 0.5〜1 倍の equal jitter でリトライが同時に殺到しないようにする
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
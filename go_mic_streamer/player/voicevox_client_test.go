@@ -0,0 +1,215 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVoicevoxClientDo(t *testing.T) {
+	t.Run("Should retry on 5xx and succeed", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"speedScale": 1.0}`))
+		}))
+		defer server.Close()
+
+		vc := NewVoicevoxClient([]string{server.URL}, time.Second, 3)
+		vc.RetryBackoff = time.Millisecond
+
+		params, err := vc.AudioQuery(context.Background(), 1, "こんにちは")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if params.SpeedScale != 1.0 {
+			t.Errorf("got %v, want %v", params.SpeedScale, 1.0)
+		}
+		if got := atomic.LoadInt32(&calls); got != 3 {
+			t.Errorf("got %d calls, want %d", got, 3)
+		}
+	})
+
+	t.Run("Should not retry on 4xx", func(t *testing.T) {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}))
+		defer server.Close()
+
+		vc := NewVoicevoxClient([]string{server.URL}, time.Second, 3)
+		vc.RetryBackoff = time.Millisecond
+
+		_, err := vc.AudioQuery(context.Background(), 1, "こんにちは")
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("got %v, want StatusError 422", err)
+		}
+		if got := atomic.LoadInt32(&calls); got != 1 {
+			t.Errorf("got %d calls, want %d", got, 1)
+		}
+	})
+
+	t.Run("Should count a retried call as one failure", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		vc := NewVoicevoxClient([]string{server.URL}, time.Second, 4)
+		vc.RetryBackoff = time.Millisecond
+
+		if _, err := vc.Speakers(context.Background()); err == nil {
+			t.Fatal("expected an error")
+		}
+		breaker := vc.pool.engines[0].breaker
+		if breaker.failures != 1 || !breaker.allow() {
+			t.Errorf("got %d failures, want 1 and the breaker closed", breaker.failures)
+		}
+	})
+
+	t.Run("Should not close a half-open breaker on 4xx", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}))
+		defer server.Close()
+
+		vc := NewVoicevoxClient([]string{server.URL}, time.Second, 0)
+		now := time.Now()
+		breaker := vc.pool.engines[0].breaker
+		breaker.now = func() time.Time { return now }
+		for i := 0; i < 5; i++ {
+			breaker.failure()
+		}
+		now = now.Add(breaker.cooldown)
+
+		if _, err := vc.Speakers(context.Background()); err == nil {
+			t.Fatal("expected an error")
+		}
+		if breaker.state != breakerHalfOpen || breaker.failures != 5 {
+			t.Errorf("got state %d with %d failures, want half-open with 5", breaker.state, breaker.failures)
+		}
+		if !breaker.allow() {
+			t.Error("breaker should allow the next probe")
+		}
+	})
+
+	t.Run("Should time out a slow engine", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer server.Close()
+
+		vc := NewVoicevoxClient([]string{server.URL}, 20*time.Millisecond, 0)
+
+		start := time.Now()
+		if _, err := vc.Speakers(context.Background()); err == nil {
+			t.Error("expected timeout error")
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("request took %v", elapsed)
+		}
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("Should open after threshold failures and half-open after cooldown", func(t *testing.T) {
+		now := time.Now()
+		cb := newCircuitBreaker(2, time.Second)
+		cb.now = func() time.Time { return now }
+
+		cb.failure()
+		if !cb.allow() {
+			t.Fatal("breaker opened too early")
+		}
+		cb.failure()
+		if cb.allow() {
+			t.Fatal("breaker should be open")
+		}
+
+		now = now.Add(time.Second)
+		if !cb.allow() {
+			t.Fatal("breaker should allow a probe")
+		}
+		if cb.allow() {
+			t.Fatal("breaker should allow only one probe")
+		}
+
+		cb.success()
+		if !cb.allow() {
+			t.Fatal("breaker should be closed after success")
+		}
+	})
+}
+
+func TestEnginePool(t *testing.T) {
+	t.Run("Should select the engine with the least outstanding requests", func(t *testing.T) {
+		pool := newEnginePool([]string{"a", "b", "c"})
+		// a は 3 件、c は 1 件処理中
+		pool.engines[0].outstanding = 3
+		pool.engines[2].outstanding = 1
+
+		for i := 0; i < 3; i++ {
+			e, err := pool.acquire()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.endpoint != "b" {
+				t.Errorf("got %s, want b", e.endpoint)
+			}
+			pool.release(e)
+		}
+	})
+
+	t.Run("Should skip unhealthy engines", func(t *testing.T) {
+		pool := newEnginePool([]string{"a", "b"})
+		pool.engines[0].setHealthy(false)
+
+		for i := 0; i < 3; i++ {
+			e, err := pool.acquire()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.endpoint != "b" {
+				t.Errorf("got %s, want b", e.endpoint)
+			}
+			pool.release(e)
+		}
+	})
+
+	t.Run("Should tell unhealthy engines from open circuits", func(t *testing.T) {
+		pool := newEnginePool([]string{"a"})
+		pool.engines[0].setHealthy(false)
+		if _, err := pool.acquire(); err != ErrNoHealthyEngine {
+			t.Errorf("got %v, want ErrNoHealthyEngine", err)
+		}
+
+		pool.engines[0].setHealthy(true)
+		for i := 0; i < 5; i++ {
+			pool.engines[0].breaker.failure()
+		}
+		if _, err := pool.acquire(); err != ErrCircuitOpen {
+			t.Errorf("got %v, want ErrCircuitOpen", err)
+		}
+	})
+
+	t.Run("Should trim the endpoints", func(t *testing.T) {
+		vc := NewVoicevoxClient([]string{"http://a:50021", " http://b:50021/", ""}, time.Second, 0)
+
+		if want := []string{"http://a:50021", "http://b:50021"}; !reflect.DeepEqual(vc.Endpoints, want) {
+			t.Errorf("got %q, want %q", vc.Endpoints, want)
+		}
+	})
+}
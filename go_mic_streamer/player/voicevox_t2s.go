@@ -1,14 +1,16 @@
 package player
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
+	"os"
 	"strconv"
-
-	"github.com/hajimehoshi/oto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Params struct {
@@ -53,7 +55,6 @@ type Styles struct {
 }
 
 type config struct {
-	endpoint   string
 	speaker    int
 	style      int
 	speed      float64
@@ -63,126 +64,431 @@ type config struct {
 	output     string
 }
 
-func Say(text string) error {
+func defaultConfig() config {
 	cfg := config{}
-	cfg.endpoint = "http://localhost:50021"
 	cfg.speaker = 0
 	cfg.style = 0
 	cfg.speed = 1.0
 	cfg.intonation = 1.0
 	cfg.volume = 1.0
 	cfg.pitch = 0.0
+	return cfg
+}
 
-	speakers := getSpeakers(cfg)
-	if cfg.speaker >= len(speakers) {
-		log.Fatal("speaker not found")
-	}
-	spk := speakers[cfg.speaker]
-	if cfg.style >= len(spk.Styles) {
-		log.Fatal("style not found")
+// Player synthesizes text with VOICEVOX and plays it. When synthesis fails and
+// FallbackFile is set, the fallback clip (e.g. a recorded apology) is played instead.
+// Text is passed through Normalizer unless it is nil. OnTiming receives mora
+// and word events while an utterance plays, and Subtitles records captions.
+// Mastering trims and levels each clip before it reaches Sink. OnTone is
+// called with true before a tone is played and with false after it.
+type Player struct {
+	Client          *VoicevoxClient
+	FallbackFile    string
+	Normalizer      *Normalizer
+	OnTiming        func(TimingEvent)
+	OnTone          func(playing bool)
+	Subtitles       *SubtitleWriter
+	Sink            Sink
+	Mastering       *Mastering
+	cfg             config
+	styles          []Styles
+	fallback        *clip
+	rate            float64
+	stretcher       *TimeStretcher
+	stretcherFormat AudioFormat
+	stopGen         atomic.Uint64
+	mu              sync.Mutex
+}
+
+// ErrStopped is returned by Say when Stop interrupted the utterance.
+var ErrStopped = errors.New("playback stopped")
+
+func NewPlayer(client *VoicevoxClient, fallbackFile string) *Player {
+	var p = &Player{
+		Client:       client,
+		FallbackFile: fallbackFile,
+		Normalizer:   NewNormalizer(),
+		Sink:         &OtoSink{},
+		Mastering:    DefaultMastering(),
+		rate:         1.0,
+		cfg:          defaultConfig(),
 	}
-	spkID := spk.Styles[cfg.style].ID
-	log.Println(spk.Name, spk.Styles[cfg.style].Name, spkID)
-	params, err := getQuery(cfg, spkID, text)
+	return p
+}
+
+var defaultPlayer = NewPlayer(NewVoicevoxClient([]string{"http://localhost:50021"}, 10*time.Second, 2), "")
+
+func Say(text string) error {
+	return defaultPlayer.Say(text)
+}
+
+func (p *Player) Say(text string) error {
+	gen := p.stopGen.Load()
+	c, err := p.synthesize(context.Background(), text)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Synthesis failed:", err)
+		if p.FallbackFile == "" {
+			return err
+		}
+		if c, err = p.loadFallback(); err != nil {
+			return err
+		}
+		// 謝罪のクリップに返答の字幕を付けない
+		text = ""
 	}
-	params.SpeedScale = cfg.speed
-	params.PitchScale = cfg.pitch
-	params.IntonationScale = cfg.intonation
-	params.VolumeScale = cfg.volume
-	b, err := synth(cfg, spkID, params)
-	if err != nil {
-		log.Fatal(err)
+
+	if p.Mastering != nil {
+		c = p.Mastering.apply(c)
 	}
+	return p.play(c, text, p.stoppedSince(gen))
+}
 
-	if err := playback(params, b[44:]); err != nil {
-		log.Fatal(err)
+// Stop interrupts the utterances that are being synthesized or played. The
+// sink gets no more audio from them and their Say returns ErrStopped.
+func (p *Player) Stop() {
+	p.stopGen.Add(1)
+}
+
+func (p *Player) stoppedSince(gen uint64) func() bool {
+	return func() bool { return p.stopGen.Load() != gen }
+}
+
+func (p *Player) play(c *clip, text string, stopped func() bool) error {
+	if stopped() {
+		return ErrStopped
+	}
+	start := time.Now()
+	rate := p.SpeechRate()
+	timing := scaleTiming(c, rate)
+	if p.Subtitles != nil && text != "" {
+		duration := c.playbackTime(c.duration(), rate)
+		if err := p.Subtitles.Add(stripMarkup(text), start, duration, words(timing)); err != nil {
+			log.Println("Could not write subtitles:", err)
+		}
+	}
+	if p.OnTiming != nil && len(timing) > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go emitTiming(timing, start, p.OnTiming, done)
 	}
+	return p.output(c, stopped)
+}
 
+// output plays c as one utterance of the sink.
+func (p *Player) output(c *clip, stopped func() bool) error {
+	marker, _ := p.Sink.(UtteranceMarker)
+	if marker != nil {
+		marker.BeginUtterance()
+	}
+	if err := p.stream(c, stopped); err != nil {
+		if marker != nil && err == ErrStopped {
+			marker.EndUtterance()
+		}
+		return err
+	}
+	if marker != nil {
+		return marker.EndUtterance()
+	}
 	return nil
 }
 
-func getSpeakers(cfg config) Speakers {
-	resp, err := http.Get(cfg.endpoint + "/speakers")
-	if err != nil {
-		log.Fatal(err)
+const (
+	playbackChunk = 50 * time.Millisecond
+	stopFade      = 20 * time.Millisecond
+)
+
+// stream feeds the clip to the sink in small chunks through the time
+// stretcher, so a rate change takes effect mid-utterance and Stop cuts in
+// within one chunk. A stopped clip is faded out instead of cut mid-waveform.
+// The raw frames of the clip bypass the stretcher.
+func (p *Player) stream(c *clip, stopped func() bool) error {
+	format := c.format()
+	ts := p.stretcherFor(format)
+	samples := pcmToSamples(c.pcm)
+	pos := 0
+	for _, r := range c.raw {
+		if err := p.feed(ts, format, samples[pos*format.Channels:r.start*format.Channels], stopped); err != nil {
+			return err
+		}
+		if err := p.feedRaw(format, samples[r.start*format.Channels:r.end*format.Channels], stopped); err != nil {
+			return err
+		}
+		pos = r.end
 	}
-	defer resp.Body.Close()
-	var speakers Speakers
-	if err := json.NewDecoder(resp.Body).Decode(&speakers); err != nil {
-		log.Fatal(err)
+	return p.feed(ts, format, samples[pos*format.Channels:], stopped)
+}
+
+func (p *Player) feed(ts *TimeStretcher, format AudioFormat, samples []int16, stopped func() bool) error {
+	if err := p.process(ts, format, samples, stopped); err != nil {
+		return err
 	}
-	return speakers
+	return p.flush(ts, format)
 }
 
-func getQuery(cfg config, id int, text string) (*Params, error) {
-	log.Println("Starting query")
-	req, err := http.NewRequest("POST", cfg.endpoint+"/audio_query", nil)
-	if err != nil {
-		return nil, err
+// process stretches samples and plays what is ready, keeping the rest in ts
+// for the samples that follow.
+func (p *Player) process(ts *TimeStretcher, format AudioFormat, samples []int16, stopped func() bool) error {
+	chunk := int(playbackChunk.Seconds()*float64(format.SampleRate)) * format.Channels
+	for len(samples) > 0 {
+		if stopped() {
+			// 残りの出力の先頭だけをフェードアウトさせてプツッと切れないようにする
+			out := fadeOut(ts.Flush(), format, stopFade)
+			if len(out) > 0 {
+				p.Sink.Play(format, samplesToPCM(out))
+			}
+			return ErrStopped
+		}
+		n := chunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+		if out := ts.Process(samples[:n]); len(out) > 0 {
+			if err := p.Sink.Play(format, samplesToPCM(out)); err != nil {
+				return err
+			}
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
+
+// flush plays the tail kept in ts.
+func (p *Player) flush(ts *TimeStretcher, format AudioFormat) error {
+	if out := ts.Flush(); len(out) > 0 {
+		return p.Sink.Play(format, samplesToPCM(out))
+	}
+	return nil
+}
+
+// feedRaw plays samples as they are, in chunks like feed.
+func (p *Player) feedRaw(format AudioFormat, samples []int16, stopped func() bool) error {
+	if p.OnTone != nil {
+		p.OnTone(true)
+		defer p.OnTone(false)
 	}
-	q := req.URL.Query()
-	q.Add("speaker", strconv.Itoa(id))
-	q.Add("text", text)
-	req.URL.RawQuery = q.Encode()
-	//log.Println(req.URL.String())
-	resp, err := http.DefaultClient.Do(req)
+	chunk := int(playbackChunk.Seconds()*float64(format.SampleRate)) * format.Channels
+	for len(samples) > 0 {
+		if stopped() {
+			if out := fadeOut(samples, format, stopFade); len(out) > 0 {
+				p.Sink.Play(format, samplesToPCM(out))
+			}
+			return ErrStopped
+		}
+		n := chunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+		if err := p.Sink.Play(format, samplesToPCM(samples[:n])); err != nil {
+			return err
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
+
+func (p *Player) stretcherFor(format AudioFormat) *TimeStretcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stretcher == nil || p.stretcherFormat != format {
+		p.stretcher = NewTimeStretcher(format)
+		p.stretcherFormat = format
+	}
+	p.stretcher.SetRate(p.rate)
+	return p.stretcher
+}
+
+// SetSpeechRate changes the playback speed without changing pitch or
+// re-synthesizing. It may be called while an utterance is playing. The rate
+// is clamped to MinSpeechRate..MaxSpeechRate.
+func (p *Player) SetSpeechRate(rate float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate = clampRate(rate)
+	if p.stretcher != nil {
+		p.stretcher.SetRate(rate)
+	}
+}
+
+func (p *Player) SpeechRate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+func (p *Player) Close() error {
+	return p.Sink.Close()
+}
+
+// synthesize renders text, which may contain speech markup, into one clip.
+// Each markup segment is a separate /audio_query with its own Params.
+func (p *Player) synthesize(ctx context.Context, text string) (*clip, error) {
+	segments, err := parseMarkup(text)
 	if err != nil {
-		return nil, err
+		log.Println("Invalid speech markup, speaking as plain text:", err)
+		segments = []speechSegment{{text: stripTags(text), prosody: prosody{speed: 1.0, volume: 1.0}}}
 	}
-	defer resp.Body.Close()
-	var params *Params
-	if err := json.NewDecoder(resp.Body).Decode(&params); err != nil {
-		return nil, err
+
+	var out *clip
+	for i, seg := range segments {
+		var c *clip
+		if seg.tone != nil {
+			format := AudioFormat{SampleRate: 24000, Channels: 1}
+			if out != nil {
+				format = out.format()
+			}
+			if c, err = seg.tone.render(format).concat(silence(seg.pause, out)); err != nil {
+				return nil, err
+			}
+		} else if strings.TrimSpace(seg.text) == "" {
+			c = silence(seg.pause, out)
+		} else {
+			c, err = p.synthesizeSegment(ctx, seg, i == 0, i == len(segments)-1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if out, err = out.concat(c); err != nil {
+			return nil, err
+		}
 	}
-	return params, nil
+	if out == nil {
+		return nil, fmt.Errorf("nothing to say")
+	}
+	return out, nil
 }
 
-func synth(cfg config, id int, params *Params) ([]byte, error) {
-	b, err := json.MarshalIndent(params, "", "  ")
+func (p *Player) synthesizeSegment(ctx context.Context, seg speechSegment, first bool, last bool) (*clip, error) {
+	spkID, err := p.resolveSpeaker(ctx, seg.prosody.style)
 	if err != nil {
 		return nil, err
 	}
-	//log.Println(string(b))
-	req, err := http.NewRequest("POST", cfg.endpoint+"/synthesis", bytes.NewReader(b))
+	text := seg.text
+	if p.Normalizer != nil {
+		text = p.Normalizer.Normalize(text)
+	}
+	params, err := p.Client.AudioQuery(ctx, spkID, text)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Accept", "audio/wav")
-	req.Header.Add("Content-Type", "application/json")
-	q := req.URL.Query()
-	q.Add("speaker", strconv.Itoa(id))
-	req.URL.RawQuery = q.Encode()
-	//log.Println(req.URL.String())
-	resp, err := http.DefaultClient.Do(req)
+	params.SpeedScale = p.cfg.speed
+	params.PitchScale = p.cfg.pitch
+	params.IntonationScale = p.cfg.intonation
+	params.VolumeScale = p.cfg.volume
+	// 繋ぎ目に無音が入らないよう、途中のセグメントは前後の無音を詰める
+	if !first {
+		params.PrePhonemeLength = segmentJoinSilence
+	}
+	if !last {
+		params.PostPhonemeLength = segmentJoinSilence
+	}
+	applyProsody(params, seg)
+
+	b, err := p.Client.Synthesis(ctx, spkID, params)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	buff := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buff, resp.Body); err != nil {
+	c, err := decodeWAV(b)
+	if err != nil {
 		return nil, err
 	}
-	return buff.Bytes(), nil
+	c.timing, _ = computeTiming(params)
+	return c, nil
 }
 
-func playback(params *Params, b []byte) error {
-	ch := 1
-	if params.OutputStereo {
-		ch = 2
+const segmentJoinSilence = 0.02
+
+// resolveSpeaker returns the style ID for the configured speaker. style may
+// name another style of that speaker or be a raw style ID.
+func (p *Player) resolveSpeaker(ctx context.Context, style string) (int, error) {
+	p.mu.Lock()
+	styles, cfg := p.styles, p.cfg
+	p.mu.Unlock()
+	if styles == nil {
+		speakers, err := p.Client.Speakers(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if cfg.speaker >= len(speakers) {
+			return 0, fmt.Errorf("speaker %d not found", cfg.speaker)
+		}
+		spk := speakers[cfg.speaker]
+		if cfg.style >= len(spk.Styles) {
+			return 0, fmt.Errorf("style %d not found for %s", cfg.style, spk.Name)
+		}
+		styles = spk.Styles
+		p.mu.Lock()
+		if p.cfg == cfg {
+			p.styles = styles
+		}
+		p.mu.Unlock()
+		log.Println(spk.Name, spk.Styles[cfg.style].Name, spk.Styles[cfg.style].ID)
+	}
+
+	if style == "" {
+		return styles[cfg.style].ID, nil
+	}
+	for _, s := range styles {
+		if s.Name == style {
+			return s.ID, nil
+		}
+	}
+	if id, err := strconv.Atoi(style); err == nil {
+		return id, nil
 	}
-	ctx, err := oto.NewContext(params.OutputSamplingRate, ch, 2, 3200)
+	return 0, fmt.Errorf("style %q not found", style)
+}
+
+// SetVoice switches to another VOICEVOX speaker, given by name or UUID, and
+// one of its styles by name; an empty style selects its first style. It
+// applies from the next utterance.
+func (p *Player) SetVoice(ctx context.Context, speaker string, style string) error {
+	speakers, err := p.Client.Speakers(ctx)
 	if err != nil {
 		return err
 	}
-	defer ctx.Close()
-	p := ctx.NewPlayer()
-	if _, err := io.Copy(p, bytes.NewReader(b)); err != nil {
-		return err
+	for i, spk := range speakers {
+		if spk.Name != speaker && spk.SpeakerUUID != speaker {
+			continue
+		}
+		styleIndex := -1
+		for j, s := range spk.Styles {
+			if style == "" || s.Name == style {
+				styleIndex = j
+				break
+			}
+		}
+		if styleIndex < 0 {
+			return fmt.Errorf("style %q not found for %s", style, spk.Name)
+		}
+		p.mu.Lock()
+		p.cfg.speaker = i
+		p.cfg.style = styleIndex
+		p.styles = spk.Styles
+		p.mu.Unlock()
+		return nil
 	}
-	if err := p.Close(); err != nil {
-		return err
+	return fmt.Errorf("speaker %q not found", speaker)
+}
+
+// voice returns the configured speaker and style.
+func (p *Player) voice() config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cfg
+}
+
+func (p *Player) loadFallback() (*clip, error) {
+	if p.fallback != nil {
+		return p.fallback, nil
 	}
-	return nil
+	b, err := os.ReadFile(p.FallbackFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := decodeWAV(b)
+	if err != nil {
+		return nil, err
+	}
+	p.fallback = c
+	return c, nil
 }
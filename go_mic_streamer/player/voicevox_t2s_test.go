@@ -0,0 +1,95 @@
+package player
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetVoice(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"name": "四国めたん", "speaker_uuid": "m", "styles": [{"id": 2, "name": "ノーマル"}, {"id": 0, "name": "あまあま"}]},
+			{"name": "ずんだもん", "speaker_uuid": "z", "styles": [{"id": 3, "name": "ノーマル"}, {"id": 1, "name": "あまあま"}]}
+		]`))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	cases := []struct {
+		speaker string
+		style   string
+		want    int
+	}{
+		{"ずんだもん", "", 3},
+		{"ずんだもん", "あまあま", 1},
+		{"m", "あまあま", 0},
+	}
+	for _, c := range cases {
+		t.Run("Should switch to "+c.speaker+" "+c.style, func(t *testing.T) {
+			p := NewPlayer(NewVoicevoxClient([]string{server.URL}, time.Second, 0), "")
+			if err := p.SetVoice(ctx, c.speaker, c.style); err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.resolveSpeaker(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got style ID %d, want %d", got, c.want)
+			}
+		})
+	}
+
+	t.Run("Should keep the voice when the speaker or style is unknown", func(t *testing.T) {
+		p := NewPlayer(NewVoicevoxClient([]string{server.URL}, time.Second, 0), "")
+		if err := p.SetVoice(ctx, "春日部つむぎ", ""); err == nil {
+			t.Error("got no error for an unknown speaker")
+		}
+		if err := p.SetVoice(ctx, "ずんだもん", "ささやき"); err == nil {
+			t.Error("got no error for an unknown style")
+		}
+		if got, _ := p.resolveSpeaker(ctx, ""); got != 2 {
+			t.Errorf("got style ID %d, want %d", got, 2)
+		}
+	})
+}
+
+func TestSayFallback(t *testing.T) {
+	t.Run("Should not caption the fallback clip with the reply", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+		dir := t.TempDir()
+		format := AudioFormat{SampleRate: 24000, Channels: 1}
+		pcm := make([]byte, 4800)
+		fallback := filepath.Join(dir, "sorry.wav")
+		if err := os.WriteFile(fallback, append(wavHeader(format, uint32(len(pcm))), pcm...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		subtitles, err := NewSubtitleWriter(filepath.Join(dir, "replies"), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewPlayer(NewVoicevoxClient([]string{server.URL}, time.Second, 0), fallback)
+		p.Sink = NullSink{}
+		p.Subtitles = subtitles
+
+		if err := p.Say("ご予約は明日の午後三時です。"); err != nil {
+			t.Fatal(err)
+		}
+		subtitles.Close()
+		srt, err := os.ReadFile(filepath.Join(dir, "replies.srt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srt) != 0 {
+			t.Errorf("got captions %q", srt)
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package recorder
+
+import (
+	"math"
+	"time"
+)
+
+type DTMFEvent struct {
+	Digit string
+	// At is the stream time of the block in which the tone was first heard.
+	At time.Duration
+}
+
+var (
+	dtmfRows    = []float64{697, 770, 852, 941}
+	dtmfColumns = []float64{1209, 1336, 1477, 1633}
+	dtmfDigits  = [4][4]string{
+		{"1", "2", "3", "A"},
+		{"4", "5", "6", "B"},
+		{"7", "8", "9", "C"},
+		{"*", "0", "#", "D"},
+	}
+)
+
+const (
+	// 8kHz で 205 サンプル相当のブロックを半分ずつ重ねて解析する
+	dtmfBlock = 25625 * time.Microsecond
+	// 何ブロック続けて同じ数字が聞こえたら押されたとみなすか
+	dtmfOnBlocks  = 2
+	dtmfOffBlocks = 2
+	// トーン 2 つがブロックのエネルギーの大半を占めていること。声の誤検出よけ
+	dtmfMinToneRatio = 0.7
+	// 各トーンの最小レベル (dBFS)
+	dtmfMinLevel = -36.0
+	// 同じ群の次に強い周波数との差
+	dtmfMinPeakRatio = 6.0
+	// 高群 / 低群のレベル差の許容範囲 (dB)
+	dtmfMaxTwist        = 4.0
+	dtmfMaxReverseTwist = 8.0
+)
+
+// DTMFDetector finds DTMF key presses in 16-bit mono PCM with the Goertzel
+// algorithm. To keep speech from being taken for a tone (talk-off), a block
+// only counts when the two tones dominate its energy (voiced sounds spread it
+// over many harmonics), stand out from the other frequencies of their group
+// and have a plausible twist, and the same digit must be heard in
+// consecutive blocks.
+type DTMFDetector struct {
+	sampleRate  int
+	blockSize   int
+	buf         []float64
+	candidate   string
+	count       int
+	misses      int
+	active      string
+	candidateAt time.Duration
+}
+
+func NewDTMFDetector(sampleRate int) *DTMFDetector {
+	return &DTMFDetector{
+		sampleRate: sampleRate,
+		blockSize:  int(dtmfBlock.Seconds() * float64(sampleRate)),
+	}
+}
+
+// Active reports whether a key is being held at the end of the last Process call.
+func (d *DTMFDetector) Active() bool {
+	return d.active != ""
+}
+
+// Pending reports whether a digit has been heard but not long enough to count
+// as a key press yet.
+func (d *DTMFDetector) Pending() bool {
+	return d.candidate != ""
+}
+
+// Latency is the longest time from the start of a tone until Process reports it.
+func (d *DTMFDetector) Latency() time.Duration {
+	return dtmfBlock + dtmfBlock/2*dtmfOnBlocks
+}
+
+// Process analyses samples, which end at stream time at, and returns a key
+// press for every tone that started.
+func (d *DTMFDetector) Process(samples []int16, at time.Duration) []DTMFEvent {
+	for _, s := range samples {
+		d.buf = append(d.buf, float64(s)/32768)
+	}
+
+	var events []DTMFEvent
+	hop := d.blockSize / 2
+	for len(d.buf) >= d.blockSize {
+		// ブロック末尾のストリーム時刻
+		end := at - time.Duration(len(d.buf)-d.blockSize)*time.Second/time.Duration(d.sampleRate)
+		blockAt := end - dtmfBlock
+		if blockAt < 0 {
+			blockAt = 0
+		}
+		if ev, ok := d.update(d.detect(d.buf[:d.blockSize]), blockAt); ok {
+			events = append(events, ev)
+		}
+		d.buf = append(d.buf[:0], d.buf[hop:]...)
+	}
+	return events
+}
+
+func (d *DTMFDetector) update(digit string, at time.Duration) (DTMFEvent, bool) {
+	if digit != "" && digit == d.active {
+		d.misses = 0
+		return DTMFEvent{}, false
+	}
+	if d.active != "" {
+		d.misses++
+		if d.misses < dtmfOffBlocks {
+			return DTMFEvent{}, false
+		}
+		d.active = ""
+		d.misses = 0
+	}
+
+	if digit == "" {
+		d.candidate = ""
+		d.count = 0
+		return DTMFEvent{}, false
+	}
+	if digit != d.candidate {
+		d.candidate = digit
+		d.candidateAt = at
+		d.count = 0
+	}
+	d.count++
+	if d.count < dtmfOnBlocks {
+		return DTMFEvent{}, false
+	}
+	d.active = digit
+	d.candidate = ""
+	d.count = 0
+	return DTMFEvent{Digit: digit, At: d.candidateAt}, true
+}
+
+// detect returns the digit in block or "" when there is none.
+func (d *DTMFDetector) detect(block []float64) string {
+	var energy float64
+	for _, v := range block {
+		energy += v * v
+	}
+	if energy == 0 {
+		return ""
+	}
+
+	row, rowPower, ok := d.strongest(block, dtmfRows)
+	if !ok {
+		return ""
+	}
+	col, colPower, ok := d.strongest(block, dtmfColumns)
+	if !ok {
+		return ""
+	}
+
+	// 正弦波の振幅 A に対して power は N*A^2/2 になる
+	minPower := float64(len(block)) * math.Pow(dbToGain(dtmfMinLevel), 2) / 2
+	if rowPower < minPower || colPower < minPower {
+		return ""
+	}
+	if (rowPower+colPower)/energy < dtmfMinToneRatio {
+		return ""
+	}
+	twist := 10 * math.Log10(colPower/rowPower)
+	if twist > dtmfMaxTwist || twist < -dtmfMaxReverseTwist {
+		return ""
+	}
+	return dtmfDigits[row][col]
+}
+
+// strongest returns the index and power of the strongest frequency of a
+// group, and whether it stands out from the rest of the group.
+func (d *DTMFDetector) strongest(block []float64, freqs []float64) (int, float64, bool) {
+	best, second := -1, 0.0
+	var bestPower float64
+	for i, f := range freqs {
+		p := d.power(block, f)
+		if p > bestPower {
+			second = bestPower
+			best, bestPower = i, p
+		} else if p > second {
+			second = p
+		}
+	}
+	if best < 0 || bestPower < second*math.Pow(10, dtmfMinPeakRatio/10) {
+		return 0, 0, false
+	}
+	return best, bestPower, true
+}
+
+// power is the Goertzel estimate of the energy of block at freq.
+func (d *DTMFDetector) power(block []float64, freq float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*freq/float64(d.sampleRate))
+	var s1, s2 float64
+	for _, v := range block {
+		s0 := v + coeff*s1 - s2
+		s2 = s1
+		s1 = s0
+	}
+	magnitude := s1*s1 + s2*s2 - coeff*s1*s2
+	return 2 * magnitude / float64(len(block))
+}
+
+func dbToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
@@ -0,0 +1,131 @@
+package recorder
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const dtmfTestRate = 16000
+
+func tones(d time.Duration, level float64, freqs ...float64) []int16 {
+	n := int(d.Seconds() * dtmfTestRate)
+	out := make([]int16, n)
+	for i := range out {
+		var v float64
+		for _, f := range freqs {
+			v += level * math.Sin(2*math.Pi*f*float64(i)/dtmfTestRate)
+		}
+		out[i] = int16(v * 32767)
+	}
+	return out
+}
+
+// detectAll feeds samples in 64-sample chunks like the recorder does.
+func detectAll(d *DTMFDetector, samples []int16) []DTMFEvent {
+	var events []DTMFEvent
+	for i := 0; i < len(samples); i += 64 {
+		end := i + 64
+		if end > len(samples) {
+			end = len(samples)
+		}
+		at := time.Duration(end) * time.Second / dtmfTestRate
+		events = append(events, d.Process(samples[i:end], at)...)
+	}
+	return events
+}
+
+func digits(events []DTMFEvent) []string {
+	var out []string
+	for _, ev := range events {
+		out = append(out, ev.Digit)
+	}
+	return out
+}
+
+func TestDTMFDetector(t *testing.T) {
+	t.Run("Should detect each key of the keypad", func(t *testing.T) {
+		for r, row := range dtmfRows {
+			for c, col := range dtmfColumns {
+				d := NewDTMFDetector(dtmfTestRate)
+				got := digits(detectAll(d, tones(80*time.Millisecond, 0.2, row, col)))
+				want := []string{dtmfDigits[r][c]}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%v+%v: got %v, want %v", row, col, got, want)
+				}
+			}
+		}
+	})
+
+	t.Run("Should report repeated presses of the same key with their times", func(t *testing.T) {
+		var samples []int16
+		samples = append(samples, tones(200*time.Millisecond, 0)...)
+		samples = append(samples, tones(100*time.Millisecond, 0.2, 770, 1336)...)
+		samples = append(samples, tones(100*time.Millisecond, 0)...)
+		samples = append(samples, tones(100*time.Millisecond, 0.2, 770, 1336)...)
+		samples = append(samples, tones(100*time.Millisecond, 0)...)
+
+		events := detectAll(NewDTMFDetector(dtmfTestRate), samples)
+
+		if got := digits(events); !reflect.DeepEqual(got, []string{"5", "5"}) {
+			t.Fatalf("got %v, want [5 5]", got)
+		}
+		for i, want := range []time.Duration{200 * time.Millisecond, 400 * time.Millisecond} {
+			if diff := events[i].At - want; diff < -dtmfBlock || diff > dtmfBlock {
+				t.Errorf("press %d at %v, want about %v", i, events[i].At, want)
+			}
+		}
+	})
+
+	t.Run("Should detect a tone over background noise", func(t *testing.T) {
+		samples := tones(100*time.Millisecond, 0.2, 941, 1477)
+		r := rand.New(rand.NewSource(1))
+		for i := range samples {
+			samples[i] += int16(r.NormFloat64() * 300)
+		}
+
+		got := digits(detectAll(NewDTMFDetector(dtmfTestRate), samples))
+
+		if !reflect.DeepEqual(got, []string{"#"}) {
+			t.Errorf("got %v, want [#]", got)
+		}
+	})
+
+	t.Run("Should ignore a single tone", func(t *testing.T) {
+		got := detectAll(NewDTMFDetector(dtmfTestRate), tones(200*time.Millisecond, 0.3, 697))
+		if len(got) != 0 {
+			t.Errorf("got %v, want none", digits(got))
+		}
+	})
+
+	t.Run("Should ignore a tone shorter than two blocks", func(t *testing.T) {
+		got := detectAll(NewDTMFDetector(dtmfTestRate), tones(20*time.Millisecond, 0.2, 697, 1209))
+		if len(got) != 0 {
+			t.Errorf("got %v, want none", digits(got))
+		}
+	})
+
+	t.Run("Should not take a voiced sound for a key", func(t *testing.T) {
+		// 基本周波数が揺れる、倍音の多い母音のような音
+		r := rand.New(rand.NewSource(2))
+		n := dtmfTestRate
+		samples := make([]int16, n)
+		var phase float64
+		for i := range samples {
+			f0 := 116 + 10*math.Sin(2*math.Pi*3*float64(i)/dtmfTestRate)
+			phase += 2 * math.Pi * f0 / dtmfTestRate
+			var v float64
+			for h := 1; h <= 30; h++ {
+				v += math.Sin(float64(h)*phase) / float64(h)
+			}
+			samples[i] = int16(v*6000 + r.NormFloat64()*200)
+		}
+
+		got := detectAll(NewDTMFDetector(dtmfTestRate), samples)
+		if len(got) != 0 {
+			t.Errorf("got %v, want none", digits(got))
+		}
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gordonklaus/portaudio"
@@ -13,7 +15,10 @@ import (
 type AudioSystem interface {
 	GetDeviceInfo()
 	Initialize() error
+	ListOutputDevices() ([]AudioDevice, error)
+	OutputDevice(deviceName string) (AudioDevice, error)
 	OpenDefaultStream(numInputChannels int, numOutputChannels int, sampleRate float64, framesPerBuffer int, args ...interface{}) (AudioSystemStream, error)
+	OpenOutputStream(deviceName string, numOutputChannels int, sampleRate float64, framesPerBuffer int, args ...interface{}) (AudioSystemStream, error)
 	Terminate() error
 }
 
@@ -23,6 +28,14 @@ type AudioSystemStream interface {
 	Start() error
 	Stop() error
 	Time() time.Duration
+	Write() error
+}
+
+type AudioDevice struct {
+	Name              string
+	HostApi           string
+	MaxOutputChannels int
+	DefaultSampleRate float64
 }
 
 type PortAudioSystem struct{}
@@ -40,6 +53,87 @@ func (p *PortAudioSystem) OpenDefaultStream(numInputChannels int, numOutputChann
 	return stream, err
 }
 
+func (p *PortAudioSystem) ListOutputDevices() ([]AudioDevice, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	var outputs []AudioDevice
+	for _, d := range devices {
+		if d.MaxOutputChannels == 0 {
+			continue
+		}
+		outputs = append(outputs, toAudioDevice(d))
+	}
+	return outputs, nil
+}
+
+// OutputDevice returns the device OpenOutputStream opens for deviceName.
+func (p *PortAudioSystem) OutputDevice(deviceName string) (AudioDevice, error) {
+	device, err := findOutputDevice(deviceName)
+	if err != nil {
+		return AudioDevice{}, err
+	}
+	return toAudioDevice(device), nil
+}
+
+// OpenOutputStream opens an output-only stream on the device named deviceName.
+// An exact name match wins; otherwise a unique case-insensitive substring match is used.
+func (p *PortAudioSystem) OpenOutputStream(deviceName string, numOutputChannels int, sampleRate float64, framesPerBuffer int, args ...interface{}) (AudioSystemStream, error) {
+	device, err := findOutputDevice(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	params := portaudio.LowLatencyParameters(nil, device)
+	params.Output.Channels = numOutputChannels
+	params.SampleRate = sampleRate
+	params.FramesPerBuffer = framesPerBuffer
+	stream, err := portaudio.OpenStream(params, args...)
+	return stream, err
+}
+
+func findOutputDevice(name string) (*portaudio.DeviceInfo, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*portaudio.DeviceInfo
+	for _, d := range devices {
+		if d.MaxOutputChannels == 0 {
+			continue
+		}
+		if d.Name == name {
+			return d, nil
+		}
+		if strings.Contains(strings.ToLower(d.Name), strings.ToLower(name)) {
+			candidates = append(candidates, d)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("output device %q not found", name)
+	case 1:
+		return candidates[0], nil
+	}
+	var names []string
+	for _, d := range candidates {
+		names = append(names, d.Name)
+	}
+	return nil, fmt.Errorf("output device %q is ambiguous: %s", name, strings.Join(names, ", "))
+}
+
+func toAudioDevice(d *portaudio.DeviceInfo) AudioDevice {
+	device := AudioDevice{
+		Name:              d.Name,
+		MaxOutputChannels: d.MaxOutputChannels,
+		DefaultSampleRate: d.DefaultSampleRate,
+	}
+	if d.HostApi != nil {
+		device.HostApi = d.HostApi.Name
+	}
+	return device
+}
+
 func (p *PortAudioSystem) GetDeviceInfo() {
 	devices, err := portaudio.Devices()
 	if err != nil {
@@ -57,21 +151,48 @@ func (p *PortAudioSystem) GetDeviceInfo() {
 	}
 }
 
+// SampleRate is the rate the microphone is recorded and segments are written at.
+const SampleRate = 16000
+
 type PCMRecorder struct {
-	BaseDir              string
-	Interval             int
-	SilentRatio          int
-	BaseLangCode         string
-	AltLangCodes         []string
-	BufferedContents     []int16
-	Input                []int16
-	IsRecording          bool
+	BaseDir          string
+	Interval         int
+	SilentRatio      int
+	BaseLangCode     string
+	AltLangCodes     []string
+	BufferedContents []int16
+	Input            []int16
+	IsRecording      bool
+	// OnSpeechStart is called from the recording goroutine when the first
+	// non-silent input of a segment is recorded. Input is held back for the
+	// DTMF detector's latency first, so a key tone never starts a segment.
+	OnSpeechStart func()
+	// OnSpeechDropped is called from the recording goroutine when a started
+	// segment was too short to send, e.g. a cough, and was thrown away.
+	OnSpeechDropped func()
+	// OnDTMF is called from the recording goroutine for every key press.
+	// Key tones are kept out of the recorded segments.
+	OnDTMF func(DTMFEvent)
+	// EncodeSegment, when set, turns a segment into the WAV file written to
+	// disk, e.g. to store it as G.711. Otherwise it is written as 16-bit PCM.
+	EncodeSegment        func(samples []int16, sampleRate int) []byte
 	recognitionStartTime time.Duration
 	silentCount          int
 	unSilentCount        int
+	paused               atomic.Bool
+	dtmf                 *DTMFDetector
+	delayed              []delayedInput
 	audioSystem          AudioSystem
 }
 
+// delayedInput is a block of input waiting until the DTMF detector has had
+// the chance to recognize a tone in it.
+type delayedInput struct {
+	samples []int16
+	at      time.Duration
+	voiced  bool
+}
+
 func NewPCMRecorder(audioSystem AudioSystem, baseDir string, interval int, silentRatio int) *PCMRecorder {
 	var pr = &PCMRecorder{
 		BaseDir:              baseDir,
@@ -79,18 +200,31 @@ func NewPCMRecorder(audioSystem AudioSystem, baseDir string, interval int, silen
 		SilentRatio:          silentRatio,
 		IsRecording:          false,
 		recognitionStartTime: -1,
+		dtmf:                 NewDTMFDetector(SampleRate),
 		audioSystem:          audioSystem,
 	}
+	pr.paused.Store(true)
 	return pr
 }
 
+// Resume starts capturing from the microphone. The recorder starts paused.
+func (pr *PCMRecorder) Resume() {
+	pr.paused.Store(false)
+}
+
+// Pause stops capturing and drops the segment in progress. It never blocks;
+// the recording goroutine picks the change up on its next iteration.
+func (pr *PCMRecorder) Pause() {
+	pr.paused.Store(true)
+}
+
 func (pr *PCMRecorder) GetDeviceInfo() {
 	pr.audioSystem.Initialize()
 	defer pr.audioSystem.Terminate()
 	pr.audioSystem.GetDeviceInfo()
 }
 
-func (pr *PCMRecorder) Start(sig chan os.Signal, filePathCh chan string, wait *sync.WaitGroup, startChan <-chan struct{}, stopChan <-chan struct{}) error {
+func (pr *PCMRecorder) Start(sig chan os.Signal, filePathCh chan string, wait *sync.WaitGroup) error {
 	wait.Add(1)
 	defer wait.Done()
 
@@ -115,31 +249,17 @@ func (pr *PCMRecorder) Start(sig chan os.Signal, filePathCh chan string, wait *s
 			select {
 			case <-sig:
 				wait.Done()
-				close(filePathCh)
-				pr.stopRecording(stream)
-				pr.IsRecording = false
-				break loop
-			case <-startChan:
-				log.Println("Received startChan")
-				// 録音開始
-				err := pr.startRecording(stream)
-				pr.IsRecording = true
-				if err != nil {
-					log.Println("Error starting recording:", err)
-					continue
-				}
-			case <-stopChan:
-				log.Println("Received stopChan")
-				// 録音停止
-				err := pr.stopRecording(stream)
-				pr.IsRecording = false
-				if err != nil {
-					log.Println("Error stopping recording:", err)
-					continue
+				if pr.IsRecording {
+					pr.stopRecording(stream)
+					pr.IsRecording = false
 				}
+				break loop
 			default:
-				if pr.IsRecording == true {
+				pr.syncRecordingState(stream)
+				if pr.IsRecording {
 					pr.processAudioInput(filePathCh, stream)
+				} else {
+					time.Sleep(10 * time.Millisecond)
 				}
 			}
 		}
@@ -150,10 +270,34 @@ func (pr *PCMRecorder) Start(sig chan os.Signal, filePathCh chan string, wait *s
 	return nil
 }
 
+// syncRecordingState starts or stops the stream to follow Pause and Resume.
+func (pr *PCMRecorder) syncRecordingState(stream *AudioSystemStream) {
+	wantRecording := !pr.paused.Load()
+	if wantRecording == pr.IsRecording {
+		return
+	}
+	if wantRecording {
+		// 録音開始
+		if err := pr.startRecording(stream); err != nil {
+			log.Println("Error starting recording:", err)
+			return
+		}
+	} else {
+		// 録音停止
+		if err := pr.stopRecording(stream); err != nil {
+			log.Println("Error stopping recording:", err)
+		}
+		pr.resetSegment()
+		pr.delayed = nil
+		pr.dtmf = NewDTMFDetector(SampleRate)
+	}
+	pr.IsRecording = wantRecording
+}
+
 func (pr *PCMRecorder) initializeAudioStream() (*AudioSystemStream, error) {
 
 	pr.Input = make([]int16, 64)
-	stream, err := pr.audioSystem.OpenDefaultStream(1, 0, 16000, len(pr.Input), pr.Input)
+	stream, err := pr.audioSystem.OpenDefaultStream(1, 0, SampleRate, len(pr.Input), pr.Input)
 	return &stream, err
 }
 
@@ -176,26 +320,74 @@ func (pr *PCMRecorder) processAudioInput(filePathCh chan string, stream *AudioSy
 		log.Fatalf("Could not read stream\n%v", err)
 	}
 
-	if pr.detectSilence(pr.Input) {
-		pr.silentCount++
-	} else {
+	pr.processInput(filePathCh, (*stream).Time())
+}
+
+// processInput handles the block in Input, which ends at stream time at.
+func (pr *PCMRecorder) processInput(filePathCh chan string, at time.Duration) {
+	pressed := pr.dtmf.Process(pr.Input, at)
+	for _, ev := range pressed {
+		if pr.OnDTMF != nil {
+			pr.OnDTMF(ev)
+		}
+	}
+	if len(pressed) > 0 {
+		// 検出までに溜めていた入力にはトーンの頭が入っているので捨てる
+		pr.delayed = nil
+	}
+
+	voiced := !pr.dtmf.Active() && !pr.detectSilence(pr.Input)
+	if voiced {
 		pr.silentCount = 0
-		pr.unSilentCount++
-		pr.record(pr.Input, (*stream).Time())
+	} else {
+		pr.silentCount++
 	}
+	pr.delayInput(pr.Input, at, voiced)
 
 	if pr.isSpeechLengthEnough() && (pr.detectSpeechStopped() || pr.detectSpeechExceededLimitation()) {
 		log.Println("speech stopped or exceeded limitation. Starting finalizing.")
 		pr.finalizeRecording(filePathCh)
+	} else if pr.detectSpeechStopped() {
+		// 短い物音は区間にせず捨てる
+		log.Println("speech too short. Dropping it.")
+		pr.resetSegment()
+		if pr.OnSpeechDropped != nil {
+			pr.OnSpeechDropped()
+		}
+	}
+}
+
+// delayInput holds input back for the DTMF detector's latency, and while it
+// is hearing a possible tone, before the voiced part is recorded.
+func (pr *PCMRecorder) delayInput(input []int16, at time.Duration, voiced bool) {
+	pr.delayed = append(pr.delayed, delayedInput{append([]int16{}, input...), at, voiced})
+
+	latency := int(pr.dtmf.Latency().Seconds() * SampleRate)
+	var held int
+	for _, in := range pr.delayed {
+		held += len(in.samples)
+	}
+	for len(pr.delayed) > 0 && held-len(pr.delayed[0].samples) >= latency && !pr.dtmf.Pending() {
+		in := pr.delayed[0]
+		pr.delayed = pr.delayed[1:]
+		held -= len(in.samples)
+		if in.voiced {
+			pr.unSilentCount++
+			pr.record(in.samples, in.at)
+		}
 	}
 }
 
 func (pr *PCMRecorder) finalizeRecording(filepathCh chan string) {
 	outputFileName := fmt.Sprintf(pr.BaseDir+"_%d.wav", int(pr.recognitionStartTime))
-	fmt.Println(outputFileName)
+	log.Println("Segment written to", outputFileName)
 	pr.writePCMData(outputFileName, pr.BufferedContents)
 	filepathCh <- outputFileName
 
+	pr.resetSegment()
+}
+
+func (pr *PCMRecorder) resetSegment() {
 	pr.BufferedContents = nil
 	pr.silentCount = 0
 	pr.unSilentCount = 0
@@ -205,6 +397,9 @@ func (pr *PCMRecorder) finalizeRecording(filepathCh chan string) {
 func (pr *PCMRecorder) record(input []int16, startTime time.Duration) {
 	if pr.recognitionStartTime == -1 {
 		pr.recognitionStartTime = startTime
+		if pr.OnSpeechStart != nil {
+			pr.OnSpeechStart()
+		}
 	}
 	pr.BufferedContents = append(pr.BufferedContents, input...)
 }
@@ -216,7 +411,8 @@ func (pr *PCMRecorder) detectSilence(input []int16) bool {
 
 	for _, bit := range input {
 		if abs(int16(bit)) > threshold {
-			fmt.Printf("%d, ", bit)
+			// 標準出力は -output pcm の音声に使うので stderr に出す
+			fmt.Fprintf(os.Stderr, "%d, ", bit)
 			silent = false
 			break
 		}
@@ -234,13 +430,19 @@ func (pr *PCMRecorder) detectSpeechStopped() bool {
 }
 
 func (pr *PCMRecorder) detectSpeechExceededLimitation() bool {
-	return len(pr.BufferedContents) >= (16000 * pr.Interval)
+	return len(pr.BufferedContents) >= (SampleRate * pr.Interval)
 }
 
 func (pr *PCMRecorder) writePCMData(outputFileName string, pcmData []int16) {
 	if exists(outputFileName) {
 		log.Fatalf("The audio file is already exists.")
 	}
+	if pr.EncodeSegment != nil {
+		if err := os.WriteFile(outputFileName, pr.EncodeSegment(pcmData, SampleRate), 0644); err != nil {
+			log.Fatalf("Could not write %s \n %v", outputFileName, err)
+		}
+		return
+	}
 	file, err := os.Create(outputFileName)
 	if err != nil {
 		log.Fatalf("Could not create a new file to write \n %v", err)
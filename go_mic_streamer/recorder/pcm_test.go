@@ -17,7 +17,7 @@ func TestStart(t *testing.T) {
 
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, 3)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, 3, 100)
 
 		wait.Add(1)
 
@@ -42,7 +42,7 @@ func TestDetectSilence(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 
 		got := pr.detectSilence(input)
 		want := true
@@ -58,7 +58,7 @@ func TestDetectSilence(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 
 		got := pr.detectSilence(input)
 		want := false
@@ -74,7 +74,7 @@ func TestDetectSpeechStopped(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 		want := true
 
 		contents := make([]int16, 64)
@@ -96,7 +96,7 @@ func TestDetectSpeechStopped(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 		want := false
 
 		contents := make([]int16, 64)
@@ -117,7 +117,7 @@ func TestDetectSpeechStopped(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 		want := false
 
 		contents := make([]int16, 64)
@@ -140,10 +140,10 @@ func TestDetectSpeechExceededLimitation(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 		want := true
 
-		pr.BufferedContents = make([]int16, 44100*pr.Interval)
+		pr.BufferedContents = make([]int16, SampleRate*pr.Interval)
 		got := pr.detectSpeechExceededLimitation()
 
 		if got != want {
@@ -155,10 +155,10 @@ func TestDetectSpeechExceededLimitation(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 		want := false
 
-		pr.BufferedContents = make([]int16, 44100*pr.Interval-1)
+		pr.BufferedContents = make([]int16, SampleRate*pr.Interval-1)
 		got := pr.detectSpeechExceededLimitation()
 
 		if got != want {
@@ -172,7 +172,7 @@ func TestRecord(t *testing.T) {
 		interval := 3
 		mockPortAudio := &MockPortAudio{}
 		baseDir := time.Now().Format("test_audio_20060102_T150405")
-		pr := NewPCMRecorder(mockPortAudio, baseDir, interval)
+		pr := NewPCMRecorder(mockPortAudio, baseDir, interval, 100)
 		want := []int16{0, 0, 0, 120, 120, 44, 66, 10, -12, 0, 0, 0, 0, 0, 0, 0}
 
 		pr.record(want, time.Now().Sub(time.Now()))
@@ -185,6 +185,69 @@ func TestRecord(t *testing.T) {
 
 }
 
+func TestProcessInput(t *testing.T) {
+	feed := func(pr *PCMRecorder, samples []int16) {
+		for i := 0; i+64 <= len(samples); i += 64 {
+			pr.Input = samples[i : i+64]
+			pr.processInput(nil, time.Duration(i+64)*time.Second/SampleRate)
+		}
+	}
+
+	t.Run("Should not start speech for a key tone", func(t *testing.T) {
+		pr := NewPCMRecorder(&MockPortAudio{}, "", 3, 100)
+		started := 0
+		pr.OnSpeechStart = func() { started++ }
+		var keys []string
+		pr.OnDTMF = func(ev DTMFEvent) { keys = append(keys, ev.Digit) }
+
+		samples := tones(200*time.Millisecond, 0.2, 770, 1336)
+		samples = append(samples, tones(300*time.Millisecond, 0)...)
+		feed(pr, samples)
+
+		if !reflect.DeepEqual(keys, []string{"5"}) {
+			t.Errorf("got keys %v, want [5]", keys)
+		}
+		if started != 0 || len(pr.BufferedContents) != 0 {
+			t.Errorf("got %d speech starts and %d samples, want none", started, len(pr.BufferedContents))
+		}
+	})
+
+	t.Run("Should start speech once the input is not a key tone", func(t *testing.T) {
+		pr := NewPCMRecorder(&MockPortAudio{}, "", 3, 100)
+		started := 0
+		pr.OnSpeechStart = func() { started++ }
+
+		samples := tones(200*time.Millisecond, 0.3, 440)
+		feed(pr, samples)
+
+		latency := int(pr.dtmf.Latency().Seconds() * SampleRate)
+		if started != 1 {
+			t.Errorf("got %d speech starts, want 1", started)
+		}
+		if got := len(pr.BufferedContents); got < len(samples)-latency-64 || got > len(samples)-latency {
+			t.Errorf("got %d samples, want about %d", got, len(samples)-latency)
+		}
+	})
+
+	t.Run("Should drop a voiced run too short to send", func(t *testing.T) {
+		pr := NewPCMRecorder(&MockPortAudio{}, "", 3, 100)
+		started, dropped := 0, 0
+		pr.OnSpeechStart = func() { started++ }
+		pr.OnSpeechDropped = func() { dropped++ }
+
+		samples := tones(100*time.Millisecond, 0.3, 440)
+		samples = append(samples, tones(time.Second, 0)...)
+		feed(pr, samples)
+
+		if started != 1 || dropped != 1 {
+			t.Errorf("got %d starts and %d drops, want 1 each", started, dropped)
+		}
+		if len(pr.BufferedContents) != 0 {
+			t.Errorf("got %d samples left, want none", len(pr.BufferedContents))
+		}
+	})
+}
+
 type MockPortAudioStream struct{}
 
 func (*MockPortAudioStream) Close() error {
@@ -215,6 +278,10 @@ func (*MockPortAudioStream) Time() time.Duration {
 	return time.Now().Sub(time.Now())
 }
 
+func (*MockPortAudioStream) Write() error {
+	return nil
+}
+
 type MockPortAudio struct{}
 
 func (*MockPortAudio) Initialize() error {
@@ -229,6 +296,18 @@ func (*MockPortAudio) GetDeviceInfo() {
 	return
 }
 
+func (*MockPortAudio) ListOutputDevices() ([]AudioDevice, error) {
+	return nil, nil
+}
+
+func (*MockPortAudio) OutputDevice(deviceName string) (AudioDevice, error) {
+	return AudioDevice{}, nil
+}
+
+func (*MockPortAudio) OpenOutputStream(deviceName string, numOutputChannels int, sampleRate float64, framesPerBuffer int, args ...interface{}) (AudioSystemStream, error) {
+	return &MockPortAudioStream{}, nil
+}
+
 func (*MockPortAudio) OpenDefaultStream(numInputChannels int, numOutputChannels int, sampleRate float64, framesPerBuffer int, args ...interface{}) (AudioSystemStream, error) {
 	return &MockPortAudioStream{}, nil
 }
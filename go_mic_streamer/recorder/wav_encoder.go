@@ -1,7 +1,6 @@
 package recorder
 
 import (
-	"fmt"
 	"log"
 	"os"
 
@@ -20,7 +19,7 @@ func NewWAVEncoder(file *os.File, buf []int16) *WAVEncoder {
 		buf:        buf,
 	}
 
-	en.writer = wav.NewWriter(file, en.numSamples, 1, 16000, 16)
+	en.writer = wav.NewWriter(file, en.numSamples, 1, SampleRate, 16)
 	return en
 }
 
@@ -31,7 +30,6 @@ func (en *WAVEncoder) Encode() {
 	}
 
 	if err := en.writer.WriteSamples(samples); err != nil {
-		fmt.Println(samples)
-		log.Fatalf("Could not write samples \n %v", err)
+		log.Fatalf("Could not write %d samples \n %v", len(samples), err)
 	}
 }